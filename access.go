@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+var (
+	access accessType
+)
+
+// Правило доступа: allow|deny;CIDR[;community:X|user:Y]
+type accessRule struct {
+	line      string
+	allow     bool
+	network   *net.IPNet
+	community string
+	user      string
+	hits      uint64 // atomic
+}
+
+type accessRuleStat struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// Префиксное дерево по битам адреса. В узле - номера правил с этим префиксом
+type accessNode struct {
+	child [2]*accessNode
+	rules []int
+}
+
+type accessType struct {
+	rules          []*accessRule
+	v4             *accessNode
+	v6             *accessNode
+	defaultAllow   bool
+	defaultHits    uint64 // atomic
+	lastFileChange time.Time
+
+	sync.RWMutex
+}
+
+func init() {
+	access.defaultAllow = true
+}
+
+// Загрузка правил доступа. Правила проверяются по порядку, применяется первое подходящее
+func (a *accessType) load() {
+	fst, err := os.Stat(fileAccess)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't Stat info of file %s\n", fileAccess)
+		}
+		return
+	}
+
+	if a.lastFileChange == fst.ModTime() { // Дата модификации файла не изменилась
+		return
+	}
+
+	fr, err := os.Open(fileAccess)
+	if err != nil {
+		log.Printf("Can't Read file %s", fileAccess)
+		return
+	}
+	defer fr.Close()
+
+	a.lastFileChange = fst.ModTime()
+
+	rules := make([]*accessRule, 0)
+	v4, v6 := &accessNode{}, &accessNode{}
+	defaultAllow := true
+
+	sc := bufio.NewScanner(fr)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		s := strings.Split(line, ";")
+		if s[0] == "default" && len(s) == 2 {
+			defaultAllow = s[1] == "allow"
+			continue
+		}
+
+		rule, err := parseAccessRule(s)
+		if err != nil {
+			log.Printf("ERROR: access rule %s:%d %q: %v\n", fileAccess, n, line, err)
+			continue
+		}
+		rule.line = line
+
+		root := v6
+		if rule.network.IP.To4() != nil {
+			root = v4
+		}
+		root.insert(rule.network, len(rules))
+		rules = append(rules, rule)
+	}
+
+	a.Lock()
+	a.rules = rules
+	a.v4 = v4
+	a.v6 = v6
+	a.defaultAllow = defaultAllow
+	atomic.StoreUint64(&a.defaultHits, 0)
+	a.Unlock()
+
+	if debug {
+		log.Printf("Access: %d rules loaded, default allow %v\n", len(rules), defaultAllow)
+	}
+}
+
+func parseAccessRule(s []string) (*accessRule, error) {
+	var rule accessRule
+
+	if len(s) < 2 || len(s) > 3 {
+		return nil, strconv.ErrSyntax
+	}
+
+	switch s[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+		rule.allow = false
+	default:
+		return nil, strconv.ErrSyntax
+	}
+
+	cidr := s[1]
+	if !strings.Contains(cidr, "/") { // Одиночный адрес
+		if strings.Contains(cidr, ":") {
+			cidr += "/128"
+		} else {
+			cidr += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		ones, _ := network.Mask.Size()
+		if len(network.Mask) == net.IPv6len {
+			ones -= 96
+		}
+		network = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, 32)}
+	}
+	rule.network = network
+
+	if len(s) == 3 {
+		switch b := strings.SplitN(s[2], ":", 2); {
+		case len(b) == 2 && b[0] == "community":
+			rule.community = b[1]
+		case len(b) == 2 && b[0] == "user":
+			rule.user = b[1]
+		default:
+			return nil, strconv.ErrSyntax
+		}
+	}
+
+	return &rule, nil
+}
+
+func (n *accessNode) insert(network *net.IPNet, rule int) {
+	ones, _ := network.Mask.Size()
+
+	for i := 0; i < ones; i++ {
+		bit := network.IP[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &accessNode{}
+		}
+		n = n.child[bit]
+	}
+
+	n.rules = append(n.rules, rule)
+}
+
+// Номер первого по порядку правила, префикс которого содержит ip и привязка совпадает
+func (a *accessType) match(ip net.IP, community, user string) int {
+	n := a.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		n = a.v4
+	} else {
+		ip = ip.To16()
+	}
+
+	best := -1
+
+	for i := 0; n != nil; i++ {
+		for _, r := range n.rules {
+			if best >= 0 && r >= best {
+				continue
+			}
+			rule := a.rules[r]
+			if rule.community != "" && rule.community != community {
+				continue
+			}
+			if rule.user != "" && rule.user != user {
+				continue
+			}
+			best = r
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.child[ip[i/8]>>(7-i%8)&1]
+	}
+
+	return best
+}
+
+// Проверка доступа для источника трапа с учётом community/пользователя SNMPv3
+func (a *accessType) check(addr net.UDPAddr, packet snmp.SnmpPacket) bool {
+	allow := a.count(addr, packet)
+	if !allow { // stats блокируется после access: /status берёт их в обратном порядке
+		stats.newDeniedTrap()
+	}
+	return allow
+}
+
+// Решение с учётом в счётчиках правил
+func (a *accessType) count(addr net.UDPAddr, packet snmp.SnmpPacket) bool {
+	community, user := accessCredentials(packet)
+
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.v4 == nil {
+		return true // Правила не загружены
+	}
+
+	r, allow := a.decide(addr.IP, community, user)
+	if r < 0 {
+		atomic.AddUint64(&a.defaultHits, 1)
+		if debug {
+			log.Printf("Access: %s community %q user %q: default allow %v\n", addr.IP.String(), community, user, allow)
+		}
+		return allow
+	}
+
+	rule := a.rules[r]
+	atomic.AddUint64(&rule.hits, 1)
+	if debug {
+		log.Printf("Access: %s community %q user %q: allow %v by rule #%d (%s)\n", addr.IP.String(), community, user, allow, r+1, rule.line)
+	}
+
+	return allow
+}
+
+// Проверка без счётчиков: перед подтверждением InformRequest. Трап учитывается позже в check
+func (a *accessType) allows(addr net.UDPAddr, packet snmp.SnmpPacket) bool {
+	community, user := accessCredentials(packet)
+
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.v4 == nil {
+		return true
+	}
+
+	_, allow := a.decide(addr.IP, community, user)
+	return allow
+}
+
+// Номер подходящего правила (-1 - правило по умолчанию) и решение. Вызывается под RLock
+func (a *accessType) decide(ip net.IP, community, user string) (int, bool) {
+	r := a.match(ip, community, user)
+	if r < 0 {
+		return r, a.defaultAllow
+	}
+	return r, a.rules[r].allow
+}
+
+// community SNMPv1/v2c или пользователь SNMPv3 для правил с привязкой
+func accessCredentials(packet snmp.SnmpPacket) (community, user string) {
+	if packet.Version != snmp.Version3 {
+		return packet.Community, ""
+	}
+	if usm, ok := packet.SecurityParameters.(*snmp.UsmSecurityParameters); ok {
+		user = usm.UserName
+	}
+	return "", user
+}
+
+// Счётчики срабатывания правил для /status
+func (a *accessType) stat() []accessRuleStat {
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.v4 == nil {
+		return nil
+	}
+
+	result := make([]accessRuleStat, 0, len(a.rules)+1)
+	for _, i := range a.rules {
+		result = append(result, accessRuleStat{Rule: i.line, Hits: atomic.LoadUint64(&i.hits)})
+	}
+
+	d := "default;deny"
+	if a.defaultAllow {
+		d = "default;allow"
+	}
+	result = append(result, accessRuleStat{Rule: d, Hits: atomic.LoadUint64(&a.defaultHits)})
+
+	return result
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+var (
+	charsets charsetsType
+
+	charsetDefaultDetect = []string{"windows-1251", "koi8-r"}
+)
+
+// Кодировки строковых значений в cred.json. Приоритет: переменная (vars.txt), хост, производитель, автоопределение
+type configCharset struct {
+	Hosts   map[string]string `json:"hosts"`   // IP или CIDR: кодировка
+	Vendors map[string]string `json:"vendors"` // Префикс OID трапа (enterprise): кодировка
+	Detect  []string          `json:"detect"`  // Кодировки для автоопределения строк не в UTF-8, [] - отключено
+}
+
+type charsetNet struct {
+	network *net.IPNet
+	enc     encoding.Encoding
+}
+
+type charsetsType struct {
+	hosts   []charsetNet
+	vendors *oidTrie
+	vendor  map[string]encoding.Encoding
+	detect  []encoding.Encoding
+
+	sync.RWMutex
+}
+
+// Кодировка по имени: cp1251, windows-1251, koi8-r, koi8-u, cp866, iso-8859-5, utf-8, ...
+func charset(name string) (encoding.Encoding, error) {
+	return htmlindex.Get(strings.ToLower(name))
+}
+
+func (c *charsetsType) load(cfg configCharset) {
+	var hosts []charsetNet
+	vendors := newOidTrie()
+	vendor := make(map[string]encoding.Encoding)
+	var detect []encoding.Encoding
+
+	for h, name := range cfg.Hosts {
+		enc, err := charset(name)
+		if err != nil {
+			log.Printf("ERROR: charset for host %s: %s, %+v\n", h, name, err)
+			continue
+		}
+		if !strings.Contains(h, "/") {
+			if strings.Contains(h, ":") {
+				h += "/128"
+			} else {
+				h += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(h)
+		if err != nil {
+			log.Printf("ERROR: charset host %s: %+v\n", h, err)
+			continue
+		}
+		hosts = append(hosts, charsetNet{network: network, enc: enc})
+	}
+
+	for oid, name := range cfg.Vendors {
+		enc, err := charset(name)
+		if err != nil {
+			log.Printf("ERROR: charset for vendor %s: %s, %+v\n", oid, name, err)
+			continue
+		}
+		if oid != "" && oid[0] != '.' {
+			oid = "." + oid
+		}
+		vendors.insert(oid)
+		vendor[oid] = enc
+	}
+
+	if cfg.Detect == nil {
+		cfg.Detect = charsetDefaultDetect
+	}
+	for _, name := range cfg.Detect {
+		enc, err := charset(name)
+		if err != nil {
+			log.Printf("ERROR: charset for detect: %s, %+v\n", name, err)
+			continue
+		}
+		detect = append(detect, enc)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.hosts = hosts
+	c.vendors = vendors
+	c.vendor = vendor
+	c.detect = detect
+}
+
+// Кодировка для трапа от хоста. Самая узкая сеть хоста, затем самый длинный префикс OID трапа. nil - не задана
+func (c *charsetsType) get(ip net.IP, trapOid string) encoding.Encoding {
+	c.RLock()
+	defer c.RUnlock()
+
+	var result encoding.Encoding
+	bits := -1
+	for _, h := range c.hosts {
+		if ones, _ := h.network.Mask.Size(); h.network.Contains(ip) && ones > bits {
+			result, bits = h.enc, ones
+		}
+	}
+	if result != nil || c.vendors == nil {
+		return result
+	}
+
+	if prefix, _, have := c.vendors.lookup(trapOid); have {
+		return c.vendor[prefix]
+	}
+
+	return nil
+}
+
+// Строка в UTF-8. При отсутствии кодировки строки не в UTF-8 определяются по числу строчных букв кириллицы
+func (c *charsetsType) decode(s string, enc encoding.Encoding) string {
+	if enc != nil {
+		if r, err := enc.NewDecoder().String(s); err == nil {
+			return r
+		}
+		return s
+	}
+
+	if printable(s) {
+		return s
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	result, best := s, 0
+	for _, e := range c.detect {
+		r, err := e.NewDecoder().String(s)
+		if err != nil || !printable(r) {
+			continue
+		}
+		score := 0
+		for _, i := range r {
+			if unicode.Is(unicode.Cyrillic, i) && unicode.IsLower(i) {
+				score++
+			}
+		}
+		if score > best {
+			result, best = r, score
+		}
+	}
+
+	return result
+}
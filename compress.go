@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Флаги заголовка протокола Zabbix
+const (
+	zbxProtocol = 0x01
+	zbxCompress = 0x02 // Данные сжаты zlib (Zabbix 4.0+)
+	zbxLarge    = 0x04 // Длины 8 байт вместо 4 (Zabbix 5.0+)
+
+	zbxMaxResponse = 16 * 1024 * 1024 // Максимальный размер ответа прокси
+)
+
+// Режимы сжатия
+const (
+	compressOff  = "off"
+	compressOn   = "on"
+	compressAuto = "auto" // Сжатие, при ошибке обмена - без сжатия на compressRetry
+)
+
+const (
+	compressRetry = time.Hour // Через сколько снова пробовать сжатие для прокси без его поддержки
+)
+
+var (
+	compression compressionType
+
+	ErrResponseTooLarge = errors.New("response too large")
+	// Прокси закрыл соединение до ответа или до конца пакета: пакет не принят
+	ErrNotAccepted = errors.New("proxy closed connection before response")
+)
+
+// Сжатие пакетов в cred.json: режим по умолчанию и для прокси (имя прокси как в БД Zabbix)
+type configCompression struct {
+	Default string            `json:"default"` // off, on, auto
+	Proxies map[string]string `json:"proxies"`
+}
+
+type compressionType struct {
+	cfg   configCompression
+	plain map[string]time.Time // Прокси без поддержки сжатия (auto): до какого времени отправлять без сжатия
+
+	sync.RWMutex
+}
+
+func init() {
+	compression.cfg.Default = compressOff
+	compression.plain = make(map[string]time.Time)
+}
+
+func checkCompressMode(mode string) error {
+	switch mode {
+	case compressOff, compressOn, compressAuto:
+		return nil
+	}
+	return fmt.Errorf("unknown compression mode %q", mode)
+}
+
+func (c *compressionType) load(cfg configCompression) {
+	if cfg.Default == "" {
+		cfg.Default = compressOff
+	}
+	if err := checkCompressMode(cfg.Default); err != nil {
+		log.Printf("ERROR: compression: %+v\n", err)
+		cfg.Default = compressOff
+	}
+	for proxy, mode := range cfg.Proxies {
+		if err := checkCompressMode(mode); err != nil {
+			log.Printf("ERROR: compression for proxy %s: %+v\n", proxy, err)
+			delete(cfg.Proxies, proxy)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.cfg = cfg
+}
+
+// Режим сжатия для прокси и нужно ли сжимать очередной пакет
+func (c *compressionType) get(proxyName string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	mode := c.cfg.Default
+	if m, have := c.cfg.Proxies[proxyName]; have {
+		mode = m
+	}
+
+	switch mode {
+	case compressOn:
+		return mode, true
+	case compressAuto:
+		return mode, time.Now().After(c.plain[proxyName])
+	}
+	return mode, false
+}
+
+// Прокси отверг пакет, не приняв его: закрыл соединение без ответа или ответил не по протоколу.
+// Остальные ошибки (тайм-аут, обрыв после начала ответа) не означают, что пакет не принят
+func rejected(err error) bool {
+	return errors.Is(err, ErrNotAccepted) || errors.Is(err, ErrBadHeader)
+}
+
+// Прокси не принял сжатый пакет
+func (c *compressionType) fallback(proxyName string, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	log.Printf("Sender: proxy %s doesn't accept compressed data (%+v), sending uncompressed for %s\n", proxyName, err, compressRetry)
+	c.plain[proxyName] = time.Now().Add(compressRetry)
+}
+
+// Пакет протокола Zabbix: заголовок, флаги, длина данных и исходная длина для сжатых данных
+func zbxPacket(data []byte, compress bool) ([]byte, error) {
+	flags := byte(zbxProtocol)
+	size := uint64(len(data))
+
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		flags |= zbxCompress
+		data = buf.Bytes()
+	}
+	if uint64(len(data)) > math.MaxUint32 || size > math.MaxUint32 {
+		flags |= zbxLarge
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, len(data)+21))
+	b.Write(header)
+	b.WriteByte(flags)
+	if flags&zbxLarge != 0 {
+		_ = binary.Write(b, binary.LittleEndian, uint64(len(data)))
+		if compress {
+			_ = binary.Write(b, binary.LittleEndian, size)
+		} else {
+			_ = binary.Write(b, binary.LittleEndian, uint64(0))
+		}
+	} else {
+		_ = binary.Write(b, binary.LittleEndian, uint32(len(data)))
+		if compress {
+			_ = binary.Write(b, binary.LittleEndian, uint32(size))
+		} else {
+			_ = binary.Write(b, binary.LittleEndian, uint32(0))
+		}
+	}
+	b.Write(data)
+
+	return b.Bytes(), nil
+}
+
+// Чтение ответа протокола Zabbix с проверкой размера
+func zbxRead(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 16)
+	if n, err := io.ReadFull(r, buf[:5]); err != nil {
+		if n == 0 && (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) {
+			return nil, fmt.Errorf("%w: %v", ErrNotAccepted, err)
+		}
+		return nil, err
+	}
+	if !bytes.Equal(buf[:4], header) || buf[4]&zbxProtocol == 0 {
+		return nil, ErrBadHeader
+	}
+	flags := buf[4]
+
+	var datalen, reserved uint64
+	if flags&zbxLarge != 0 {
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return nil, err
+		}
+		datalen = binary.LittleEndian.Uint64(buf[:8])
+		reserved = binary.LittleEndian.Uint64(buf[8:16])
+	} else {
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		datalen = uint64(binary.LittleEndian.Uint32(buf[:4]))
+		reserved = uint64(binary.LittleEndian.Uint32(buf[4:8]))
+	}
+
+	if datalen > zbxMaxResponse {
+		return nil, ErrResponseTooLarge
+	}
+	data := make([]byte, datalen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if flags&zbxCompress == 0 {
+		return data, nil
+	}
+
+	if reserved > zbxMaxResponse {
+		return nil, ErrResponseTooLarge
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	result, err := io.ReadAll(io.LimitReader(zr, zbxMaxResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > zbxMaxResponse {
+		return nil, ErrResponseTooLarge
+	}
+
+	return result, nil
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	snmp "github.com/gosnmp/gosnmp"
+	"golang.org/x/text/encoding"
 )
 
 const (
@@ -31,39 +34,63 @@ var (
 )
 
 type trapRaw struct {
-	time   time.Time
-	addr   net.UDPAddr
-	packet snmp.SnmpPacket
+	time      time.Time
+	addr      net.UDPAddr
+	transport string // UDP или TCP, адрес TCP источника тоже хранится в addr
+	packet    snmp.SnmpPacket
+	raw       []byte
 }
 
 type snmpPacket struct {
 	oid     string
 	value   string
 	name    string
+	index   string // Индекс экземпляра: часть OID после OID переменной
+	raw     string // Исходные байты строкового значения до преобразования
 	asn1BER snmp.Asn1BER
 }
 
 type trapType struct {
-	time   time.Time
-	addr   net.UDPAddr
-	packet []snmpPacket
+	time      time.Time
+	addr      net.UDPAddr
+	transport string
+	count     int // Количество повторов трапа, 0 - без подавления повторов
+	packet    []snmpPacket
 }
 
 type oidType struct {
 	name         string
 	unknownValue string
 	wait         int
+	dedup        int          // Окно подавления повторов, секунд
+	dedupCount   bool         // Задерживать трап на окно dedup и отправлять с количеством повторов
+	key          *keyTemplate // Шаблон ключа элемента данных
+	payload      payloadType  // Формат значения элемента данных
+	index        []indexSpec  // Индекс объекта трапа для ключа и трапа "потери", по умолчанию ifIndex
+	pair         string       // OID парного трапа: восстановления для трапа проблемы и наоборот
+	recovery     bool         // Трап восстановления
+	flapCount    int          // Флаппинг: больше flapCount переходов за flapWindow секунд
+	flapWindow   int
 }
 
 type trapOidType struct {
 	oid            map[string]oidType
 	lastFileChange time.Time
+	names          templateNamesType // Состояние файлов имён, с которым проверены шаблоны
 
 	sync.RWMutex
 }
 
+// Переменная трапа из vars.txt
+type varType struct {
+	name    string
+	hint    string            // Формат значения: hex, mac, ascii, utf8, datetime, oid, duration
+	charset encoding.Encoding // Кодировка строкового значения
+}
+
 type varOidType struct {
-	oid            map[string]string
+	oid            map[string]varType
+	trie           *oidTrie // Для поиска по префиксу, строится из oid
 	lastFileChange time.Time
 
 	sync.RWMutex
@@ -72,10 +99,16 @@ type varOidType struct {
 type trapConverted struct {
 	time      time.Time
 	addr      net.UDPAddr
+	transport string
 	name      string
 	lastDigit string
 	oid       string
 	ifIndex   string
+	count     int
+	index     []string // Значения индекса объекта трапа
+	host      string   // Хост Zabbix для отправки вместо хостов по IP источника (сценарий)
+	key       *keyTemplate
+	payload   payloadType
 	packet    []snmpPacket
 }
 
@@ -98,6 +131,40 @@ type configCreditionals struct {
 	SNMPv3_user     string              `json:"snmpv3_user"`
 	SNMPv3_password string              `json:"snmpv3_password"`
 	SNMPv3_authtype string              `json:"snmpv3_authtype"`
+	SNMPv3_users    []configUSMUser     `json:"snmpv3_users"`
+	SNMPv3_engines  map[string]string   `json:"snmpv3_engines"`      // IP или имя хоста: engineID (hex)
+	SNMPv3_learn    bool                `json:"snmpv3_engine_learn"` // Запоминать engineID хостов из БД
+	SNMPv3_local    string              `json:"snmpv3_local_engine_id"`
+	Listen          []string            `json:"listen"` // "udp://0.0.0.0:162", "udp://[::]:162", "tcp://0.0.0.0:162"
+	Storm           configStorm         `json:"storm"`
+	Charset         configCharset       `json:"charset"`
+	Payload         configPayload       `json:"payload"`
+	Spool           configSpool         `json:"spool"`
+	Compression     configCompression   `json:"compression"`
+}
+
+// Пользователь SNMPv3 в creditionals file
+type configUSMUser struct {
+	User         string `json:"user"`
+	AuthProtocol string `json:"auth_protocol"` // MD5, SHA, SHA224, SHA256, SHA384, SHA512
+	AuthPassword string `json:"auth_password"`
+	PrivProtocol string `json:"priv_protocol"` // DES, AES, AES192, AES256, AES192C, AES256C
+	PrivPassword string `json:"priv_password"`
+}
+
+// Список пользователей SNMPv3 с учётом старого формата (snmpv3_user/snmpv3_password)
+func (c configCreditionals) usmUsers() []configUSMUser {
+	if c.SNMPv3_user == "" {
+		return c.SNMPv3_users
+	}
+
+	user := configUSMUser{User: c.SNMPv3_user}
+	if c.SNMPv3_authtype != "NoAuthNoPriv" {
+		user.AuthProtocol = "SHA"
+		user.AuthPassword = c.SNMPv3_password
+	}
+
+	return append([]configUSMUser{user}, c.SNMPv3_users...)
 }
 
 // Struct for database PGSQL
@@ -111,7 +178,9 @@ type configPSQL struct {
 
 type instanceZabbix struct {
 	// Name string       `json:"zabbix"`
-	PSQL []configPSQL `json:"config_psql"`
+	PSQL    []configPSQL           `json:"config_psql"`
+	TLS     *configTLS             `json:"tls"`     // Подключение к прокси instance
+	Proxies map[string]configProxy `json:"proxies"` // Параметры прокси по имени
 }
 
 type instancesZabbix struct {
@@ -126,9 +195,14 @@ type instancesZabbix struct {
 // Gorutine поддержки конфигурации в актуальном состоянии
 func loadConfigs() {
 	for {
+		loadVars() // Имена переменных нужны для проверки шаблонов traps.txt
+		mibs.load()
+		rules.load()
+		scripts.load()
 		loadOids()
-		loadVars()
+		access.load()
 		dbs.loadConfig()
+		proxyTLS.check()
 		cluster.loadCluster()
 
 		time.Sleep(configTimeSleep * time.Second)
@@ -170,9 +244,14 @@ func (d *instancesZabbix) loadConfig() {
 		if crd.ServicePort != "" { // Имеет значение по умолчанию
 			servicePort = crd.ServicePort
 		}
-		snmpv3_user = crd.SNMPv3_user
-		snmpv3_password = crd.SNMPv3_password
-		snmpv3_authtype = crd.SNMPv3_authtype
+		usmUsers.load(crd.usmUsers())
+		engines.load(crd.SNMPv3_engines, crd.SNMPv3_learn, crd.SNMPv3_local)
+		listeners.load(crd.Listen)
+		storm.load(crd.Storm)
+		charsets.load(crd.Charset)
+		payloadDefault.load(crd.Payload)
+		spools.load(crd.Spool)
+		compression.load(crd.Compression)
 		credCond.L.Unlock()
 		credCond.Broadcast()
 
@@ -219,6 +298,7 @@ func (d *instancesZabbix) loadConfig() {
 			dbs.i[z] = i
 			dbs.Unlock()
 		}
+		proxyTLS.load(inst, certType{pem: crd.CertPEM, key: crd.CertKEY, root: crd.CertROOT})
 		if len(dd) < len(dbs.i) { // Из файла удалены какие-то instance
 			dbs.Lock()
 			for i := range dbs.i {
@@ -236,7 +316,7 @@ func (d *instancesZabbix) loadConfig() {
 // Загрузка переменных Trap
 func loadVars() {
 	if varOids.oid == nil {
-		varOids.oid = make(map[string]string)
+		varOids.oid = make(map[string]varType)
 	}
 
 	fst, err := os.Stat(fileVars)
@@ -264,7 +344,15 @@ func loadVars() {
 			if s[0][0] != '.' { // Исправляем ошибку когда OID в файле не начинается с "."
 				s[0] = "." + s[0]
 			}
-			varOids.oid[s[0]] = s[1]
+			v := varType{name: s[1]}
+			if len(s) > 2 && s[2] != "" {
+				if renderHints[s[2]] {
+					v.hint = s[2]
+				} else if v.charset, err = charset(s[2]); err != nil {
+					log.Printf("ERROR: LoadVars %s unknown format hint or charset %s\n", s[0], s[2])
+				}
+			}
+			varOids.oid[s[0]] = v
 			sd[s[0]] = true
 		}
 		if len(sd) < len(varOids.oid) { // Из файла удалены какие-то OID
@@ -274,6 +362,10 @@ func loadVars() {
 				}
 			}
 		}
+		varOids.trie = newOidTrie()
+		for i := range varOids.oid {
+			varOids.trie.insert(i)
+		}
 		varOids.Unlock()
 
 		if debug {
@@ -294,6 +386,16 @@ func loadOids() {
 		return
 	}
 
+	// Шаблоны проверяются при изменении traps.txt, vars.txt, MIB, правил или сценариев
+	names := templateNames()
+	recheck := trapOids.names != names
+	trapOids.names = names
+	defer func() {
+		if recheck {
+			checkTemplates()
+		}
+	}()
+
 	if trapOids.lastFileChange != fst.ModTime() { // Дата модификации файла отличается от последней прочитанной
 		var s []string
 		var oid oidType
@@ -306,6 +408,7 @@ func loadOids() {
 		defer fr.Close()
 
 		sd := make(map[string]bool) // Для удаления из мапы
+		var pairs []string          // Трапы проблемы с параметром pair в порядке файла
 		trapOids.lastFileChange = fst.ModTime()
 		sc := bufio.NewScanner(fr)
 		trapOids.Lock()
@@ -317,18 +420,32 @@ func loadOids() {
 			if s[0][0] != '.' { // Исправляем ошибку когда OID в файле не начинается с "."
 				s[0] = "." + s[0]
 			}
-			oid.name = s[1]
-			if len(s) == 4 {
+			oid = oidType{name: s[1]}
+			if len(s) >= 4 {
 				oid.unknownValue = s[2]
-				if oid.wait, err = strconv.Atoi(s[3]); err != nil {
+				if oid.wait, err = strconv.Atoi(s[3]); err != nil && s[3] != "" {
 					log.Printf("ERROR: LoadOIDs strconv.Atoi: %s, %+v\n", s[3], err)
 				}
-			} else {
-				oid.unknownValue = ""
-				oid.wait = 0
+			}
+			if len(s) > 4 { // Дополнительные параметры трапа: key=value
+				for _, o := range s[4:] {
+					kv := strings.SplitN(o, "=", 2)
+					if len(kv) == 1 {
+						kv = append(kv, "")
+					}
+					if err := oid.setOption(kv[0], kv[1]); err != nil {
+						log.Printf("ERROR: LoadOIDs %s option %s: %+v\n", s[0], o, err)
+					}
+				}
+				if err := oid.payload.check(); err != nil {
+					log.Printf("ERROR: LoadOIDs %s payload: %+v\n", s[0], err)
+				}
 			}
 			trapOids.oid[s[0]] = oid
 			sd[s[0]] = true
+			if oid.pair != "" {
+				pairs = append(pairs, s[0])
+			}
 		}
 		if len(sd) < len(trapOids.oid) { // Из файла удалены какие-то OID
 			for i := range trapOids.oid {
@@ -337,7 +454,9 @@ func loadOids() {
 				}
 			}
 		}
+		trapOids.resolvePairs(pairs)
 		trapOids.Unlock()
+		recheck = true
 
 		if debug {
 			log.Printf("%v\n", trapOids.oid)
@@ -345,6 +464,76 @@ func loadOids() {
 	}
 }
 
+// Состояние файлов, из которых берутся имена подстановок шаблонов. Читается в горутине loadConfigs,
+// которая единственная изменяет эти поля
+type templateNamesType struct {
+	vars, mibs, rules, scripts time.Time
+	mibFiles, scriptFiles      int
+}
+
+func templateNames() templateNamesType {
+	return templateNamesType{
+		vars:        varOids.lastFileChange,
+		mibs:        mibs.lastChange,
+		rules:       rules.lastFileChange,
+		scripts:     scripts.lastChange,
+		mibFiles:    mibs.files,
+		scriptFiles: scripts.files,
+	}
+}
+
+// Проверка подстановок шаблонов traps.txt и cred.json. Шаблон с неизвестной подстановкой применяется
+// (подстановка даёт пустую строку), чтобы опечатка или удалённая переменная не меняли ключ элемента данных
+func checkTemplates() {
+	trapOids.RLock()
+	oids := make([]string, 0, len(trapOids.oid))
+	for oid := range trapOids.oid {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+	for _, oid := range oids {
+		o := trapOids.oid[oid]
+		if o.key != nil {
+			if err := o.key.check(); err != nil {
+				log.Printf("WARNING: LoadOIDs %s key: %+v\n", oid, err)
+			}
+		}
+		if o.payload.text != nil {
+			if err := o.payload.text.check(); err != nil {
+				log.Printf("WARNING: LoadOIDs %s text: %+v\n", oid, err)
+			}
+		}
+	}
+	trapOids.RUnlock()
+
+	payloadDefault.checkText()
+}
+
+// Параметр трапа из traps.txt
+func (o *oidType) setOption(key, value string) (err error) {
+	switch key {
+	case "dedup":
+		o.dedup, err = strconv.Atoi(value)
+	case "count":
+		o.dedupCount = true
+	case "key":
+		o.key, err = parseKeyTemplate(value) // Подстановки проверяются в checkTemplates
+	case "payload":
+		o.payload.format = value
+	case "text":
+		o.payload.text, err = parseTextTemplate(value)
+	case "index":
+		o.index, err = parseIndexSpec(value)
+	case "pair":
+		o.pair = value // OID или имя трапа восстановления, проверяется после загрузки файла
+	case "flap":
+		o.flapCount, o.flapWindow, err = parseFlap(value)
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return
+}
+
 func (c *clusterType) loadCluster() {
 	// clusterCond.L.Lock()
 	// defer clusterCond.Broadcast()
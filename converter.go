@@ -2,6 +2,9 @@ package main
 
 import (
 	"strings"
+
+	snmp "github.com/gosnmp/gosnmp"
+	"golang.org/x/text/encoding"
 )
 
 func trapConverter() {
@@ -10,54 +13,103 @@ func trapConverter() {
 	for trap := range chTrapFiltered {
 		converted.time = trap.time
 		converted.addr = trap.addr
+		converted.transport = trap.transport
+		converted.count = trap.count
 		converted.name = trap.packet[1].name
 		converted.oid = trap.packet[1].oid
 		converted.lastDigit = lastDigit(trap.packet[1].oid)
 		converted.ifIndex = ifIndex(trap.packet[2:])
-		converted.packet = fillVarName(trap.packet[2:])
+		converted.packet = fillVarName(trap.packet[2:], charsets.get(trap.addr.IP, trap.packet[1].oid))
+
+		cfg := trapOids.get(trap.packet[1].oid)
+		converted.index = trapIndex(cfg.index, converted.packet, converted.ifIndex)
+		converted.key = cfg.key
+		converted.payload = cfg.payload
+		converted.packet = rules.apply(converted)
+		converted.host = ""
+		if !scripts.run(&converted) { // Трап отброшен сценарием
+			continue
+		}
 
+		if cfg.pair != "" { // Отправляется из trapLost после проверки на флаппинг
+			chTrapLost <- converted
+			continue
+		}
 		chTrapConverted <- converted
 		chTrapLost <- converted
 	}
 }
 
-func fillVarName(p []snmpPacket) (result []snmpPacket) { // Интересно, можно такую конструкцию делать?
+func fillVarName(p []snmpPacket, enc encoding.Encoding) (result []snmpPacket) { // Интересно, можно такую конструкцию делать?
 	for _, i := range p {
-		if varOids.name(i.oid) != "ifIndex" {
-			i.name = varOids.name(i.oid)
-		} else {
-			i.name = ""
+		var v varType
+		v, i.index = varName(i.oid)
+		i.name = v.name
+		charset := enc
+		if v.charset != nil { // Кодировка переменной из vars.txt
+			charset = v.charset
 		}
-		if i.name != "" {
-			result = append(result, i)
+		if i.asn1BER == snmp.OctetString {
+			i.raw = i.value
 		}
+		i.value = renderValue(i, v.hint, charset)
+		result = append(result, i) // Неименованные переменные нужны для формата rich и snmptrapd
 	}
 	return
 }
 
 func ifIndex(p []snmpPacket) string {
 	for _, i := range p {
-		if varOids.name(i.oid) == "ifIndex" {
+		if v, _ := varName(i.oid); v.name == "ifIndex" {
 			return i.value
 		}
 	}
 	return ""
 }
 
+// Переменная и индекс экземпляра из vars.txt, при отсутствии - из MIB
+func varName(oid string) (varType, string) {
+	if v, index := varOids.lookup(oid); v.name != "" {
+		return v, index
+	}
+	if node, index := mibs.object(oid); node != nil {
+		return varType{name: node.name}, index
+	}
+	return varType{}, ""
+}
+
 func lastDigit(s string) string {
 	v := strings.Split(s, ".")
 	return v[len(v)-1]
 }
 
 func (v *varOidType) name(oid string) string {
+	z, _ := v.lookup(oid)
+	return z.name
+}
+
+// Имя переменной есть в vars.txt
+func (v *varOidType) has(name string) bool {
 	v.RLock()
 	defer v.RUnlock()
 
-	for i, z := range v.oid {
-		if strings.HasPrefix(oid, i) {
-			return z
+	for _, i := range v.oid {
+		if i.name == name {
+			return true
 		}
 	}
+	return false
+}
 
-	return ""
+// Самый длинный совпадающий префикс из vars.txt и индекс экземпляра
+func (v *varOidType) lookup(oid string) (varType, string) {
+	v.RLock()
+	defer v.RUnlock()
+
+	if v.trie == nil {
+		return varType{}, ""
+	}
+	prefix, index, _ := v.trie.lookup(oid)
+
+	return v.oid[prefix], index
 }
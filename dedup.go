@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha1"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	dedup dedupType
+)
+
+type dedupEntry struct {
+	trap   trapType
+	expire time.Time
+	held   bool // Трап задержан до окончания окна (параметр count)
+}
+
+type dedupType struct {
+	d map[[sha1.Size]byte]*dedupEntry
+
+	sync.Mutex
+}
+
+func init() {
+	dedup.d = make(map[[sha1.Size]byte]*dedupEntry)
+}
+
+func (o *trapOidType) haveDedup(oid string) (int, bool) {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.oid[oid].dedup, o.oid[oid].dedupCount
+}
+
+// Ключ трапа: источник, OID трапа и отсортированный набор переменных без sysUpTime
+func dedupKey(trap trapType) [sha1.Size]byte {
+	vars := make([]string, 0, len(trap.packet))
+	for _, p := range trap.packet {
+		if p.oid == oidSysUpTime || p.value == oidSnmpTrapOID {
+			continue
+		}
+		vars = append(vars, p.oid+"="+p.value)
+	}
+	sort.Strings(vars)
+
+	h := sha1.New()
+	h.Write([]byte(trap.addr.IP.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(trap.packet[1].oid))
+	for _, v := range vars {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+
+	var key [sha1.Size]byte
+	copy(key[:], h.Sum(nil))
+
+	return key
+}
+
+// Проверка на повтор. true - трап отправляется сразу
+func (d *dedupType) check(trap trapType) bool {
+	window, count := trapOids.haveDedup(trap.packet[1].oid)
+	if window <= 0 {
+		return true
+	}
+
+	key := dedupKey(trap)
+	now := time.Now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	if e, have := d.d[key]; have && now.Before(e.expire) {
+		e.trap.count++
+		stats.newDuplicateTrap()
+		return false
+	}
+
+	trap.count = 1
+	d.d[key] = &dedupEntry{
+		trap:   trap,
+		expire: now.Add(time.Duration(window) * time.Second),
+		held:   count,
+	}
+
+	return !count
+}
+
+// Отправка задержанных трапов по окончании окна. Запускать в 1 поток
+func (d *dedupType) flusher() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, trap := range d.expired() {
+			chTrapFiltered <- trap
+		}
+	}
+}
+
+func (d *dedupType) expired() (result []trapType) {
+	now := time.Now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	for k, e := range d.d {
+		if now.Before(e.expire) {
+			continue
+		}
+		if e.held {
+			result = append(result, e.trap)
+		}
+		delete(d.d, k)
+	}
+
+	return
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	engines enginesType
+)
+
+// Таблица authoritative engineID отправителей SNMPv3
+type enginesType struct {
+	e       map[string]string // Из cred.json. Ключ: IP или имя хоста
+	learned map[string]string // Выученные. Ключ: IP
+	learn   bool
+	local   string // Наш engineID для приёма SNMPv3 InformRequest
+	boots   uint32 // snmpEngineBoots нашего engineID, увеличивается при каждом запуске
+
+	sync.RWMutex
+}
+
+func init() {
+	engines.e = make(map[string]string)
+	engines.learned = make(map[string]string)
+}
+
+// Перезагрузка таблицы из cred.json
+func (e *enginesType) load(cfg map[string]string, learn bool, local string) {
+	ee := make(map[string]string)
+
+	localID, err := parseEngineID(local)
+	if err != nil {
+		if local != "" {
+			log.Println("Engines: local engine ID ignored:", err)
+		}
+		localID = defaultEngineID()
+	}
+
+	for k, v := range cfg {
+		id, err := parseEngineID(v)
+		if err != nil {
+			log.Printf("Engines: %s skipped: %v\n", k, err)
+			continue
+		}
+		ee[k] = id
+	}
+
+	e.Lock()
+	e.e = ee
+	e.local = localID
+	if learn && !e.learn {
+		e.loadLearned()
+	}
+	e.learn = learn
+	e.Unlock()
+}
+
+// Чтение выученных engineID. Вызывается под блокировкой
+func (e *enginesType) loadLearned() {
+	b, err := os.ReadFile(fileEngines)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Engines: can't read", fileEngines, err)
+		}
+		return
+	}
+
+	var learned map[string]string
+	if err := json.Unmarshal(b, &learned); err != nil {
+		log.Println("Engines: can't Unmarshal", fileEngines, err)
+		return
+	}
+
+	for k, v := range learned {
+		if id, err := parseEngineID(v); err == nil {
+			e.learned[k] = id
+		}
+	}
+}
+
+// Запись выученных engineID. Вызывается под блокировкой
+func (e *enginesType) saveLearned() {
+	learned := make(map[string]string, len(e.learned))
+	for k, v := range e.learned {
+		learned[k] = hex.EncodeToString([]byte(v))
+	}
+
+	b, err := json.MarshalIndent(learned, "", "    ")
+	if err != nil {
+		log.Println("Engines: can't Marshal:", err)
+		return
+	}
+
+	if err := os.WriteFile(fileEngines+".tmp", b, 0644); err != nil {
+		log.Println("Engines: can't write", fileEngines, err)
+		return
+	}
+	if err := os.Rename(fileEngines+".tmp", fileEngines); err != nil {
+		log.Println("Engines: can't rename", fileEngines, err)
+	}
+}
+
+// Проверка engineID трапа от addr. Выученные engineID проверяются только в режиме обучения
+func (e *enginesType) check(addr net.UDPAddr, engineID string) error {
+	ip := addr.IP.String()
+
+	e.RLock()
+	id, have := e.e[ip]
+	if !have && e.learn {
+		id, have = e.learned[ip]
+	}
+	if !have {
+		for _, name := range hosts.names(addr) {
+			if id, have = e.e[name]; have {
+				break
+			}
+		}
+	}
+	e.RUnlock()
+
+	if have && id != engineID {
+		return fmt.Errorf("engine ID %x does not match %x configured for %s", engineID, id, ip)
+	}
+
+	return nil
+}
+
+// snmpEngineBoots хранится в файле рядом с выученными engineID (RFC3414 2.2): после перезапуска время
+// engineID начинается с нуля, и отправители InformRequest принимают нас только с большим значением boots
+func (e *enginesType) startBoots() {
+	file := fileEngines + ".boots"
+	boots := uint64(1)
+
+	if b, err := os.ReadFile(file); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32); err == nil {
+			boots = n + 1
+		} else {
+			log.Println("Engines: wrong engine boots in", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Println("Engines: can't read", file, err)
+	}
+	if boots > math.MaxInt32 { // Максимум snmpEngineBoots, дальше значение не меняется
+		boots = math.MaxInt32
+	}
+
+	if err := os.WriteFile(file+".tmp", []byte(strconv.FormatUint(boots, 10)+"\n"), 0644); err != nil {
+		log.Println("Engines: can't write", file, err)
+	} else if err := os.Rename(file+".tmp", file); err != nil {
+		log.Println("Engines: can't rename", file, err)
+	}
+
+	e.Lock()
+	e.boots = uint32(boots)
+	e.Unlock()
+
+	log.Printf("Engines: engine boots %d\n", boots)
+}
+
+// snmpEngineBoots и snmpEngineTime нашего engineID
+func (e *enginesType) localTime() (boots, engineTime uint32) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.boots, uint32(time.Since(startTime).Seconds())
+}
+
+// engineID из cred.json, выученный или наш
+func (e *enginesType) known(engineID string) bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	if engineID == e.local {
+		return true
+	}
+	for _, id := range e.e {
+		if id == engineID {
+			return true
+		}
+	}
+	for _, id := range e.learned {
+		if id == engineID {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *enginesType) localID() string {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.local
+}
+
+// Запоминаем engineID хоста из hosts в режиме обучения. Только после успешной проверки подписи трапа
+func (e *enginesType) learnFrom(addr net.UDPAddr, engineID string) {
+	ip := addr.IP.String()
+
+	e.RLock()
+	_, have := e.learned[ip]
+	if !have {
+		_, have = e.e[ip]
+	}
+	learn := e.learn
+	e.RUnlock()
+
+	if have || !learn || len(engineID) < 5 || !hosts.have(addr) {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if _, have := e.learned[ip]; !have {
+		e.learned[ip] = engineID
+		e.saveLearned()
+		log.Printf("Engines: learned engine ID %x for %s\n", engineID, ip)
+	}
+}
+
+// Удаление выученного engineID, например после замены оборудования. Следующий трап с проверенной подписью
+// в режиме обучения запомнит новый engineID
+func (e *enginesType) forget(ip string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	id, have := e.learned[ip]
+	if !have {
+		return false
+	}
+	delete(e.learned, ip)
+	e.saveLearned()
+	log.Printf("Engines: forgot engine ID %x for %s\n", id, ip)
+
+	return true
+}
+
+func forgetEngine(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	ip := mux.Vars(r)["ip"]
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "wrong IP address "+ip, http.StatusBadRequest)
+		return
+	}
+
+	if !engines.forget(net.ParseIP(ip).String()) {
+		http.Error(w, "no learned engine ID for "+ip, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// engineID по умолчанию из имени хоста (RFC3411, формат text, enterprise net-snmp)
+func defaultEngineID() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = "zabbixtrapd"
+	}
+	if len(name) > 27 {
+		name = name[:27]
+	}
+
+	return "\x80\x00\x1f\x88\x04" + name
+}
+
+// engineID в виде hex строки: "80001f8880..." , "0x80001f8880..." или "80:00:1f:88:80..."
+func parseEngineID(s string) (string, error) {
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	s = strings.ReplaceAll(s, ":", "")
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 5 || len(b) > 32 { // RFC3411: SnmpEngineID (SIZE(5..32))
+		return "", fmt.Errorf("engine ID length %d out of range 5..32", len(b))
+	}
+
+	return string(b), nil
+}
@@ -2,14 +2,24 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	snmp "github.com/gosnmp/gosnmp"
 )
 
+const (
+	oidSysUpTime          = ".1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID        = ".1.3.6.1.6.3.1.1.4.1.0"
+	oidSnmpTrapEnterprise = ".1.3.6.1.6.3.1.1.4.3.0"
+	oidSnmpTrapAddress    = ".1.3.6.1.6.3.18.1.3.0"
+	oidSnmpTraps          = ".1.3.6.1.6.3.1.1.5"
+)
+
 var (
 	community communityType
 	r         *rand.Rand
@@ -35,13 +45,36 @@ func trapRawFilter() {
 		// 	fmt.Printf("TrapRawFilter: Before\ntime %+v\naddr %+v\npacket %+v\n\n", trap.time, trap.addr.IP, trap.packet)
 		// }
 
+		if trap.packet.PDUType == snmp.Trap { // SNMPv1 Trap-PDU приводим к виду SNMPv2
+			trap.packet.Variables = v1ToV2(trap.packet)
+			trap.packet.PDUType = snmp.SNMPv2Trap
+		}
+
+		if reason, detail := validateTrap(trap.packet); reason != "" { // Некорректный трап - в карантин
+			stats.newMalformedTrap(trap.addr.IP.String(), reason)
+			quarantine.add(trap, reason, detail)
+			if debug {
+				log.Printf("Malformed trap from %s: %s, %s\n", trap.addr.IP.String(), reason, detail)
+			}
+			continue
+		}
+
 		if trap.addr.IP.IsLoopback() && trap.packet.Version == snmp.Version3 { // Тестовый трап
 			trap.addr = randomHostSource()
 			// fmt.Println("Test trap:", trap.addr.IP.IsLoopback(), trap.addr.IP.String())
 			stats.newFilteredTrap(0)
 		}
 
-		if !cluster.master() || !checkIP(trap.addr) || !checkOid(trap.packet.Variables[1]) || !hosts.have(trap.addr) || !community.check(trap.packet) { // Проверяем на валидный IP и OID + имеется ли host в zabbix + community
+		if !checkIP(trap.addr, trap.packet) || !checkOid(trap.packet.Variables[1]) || !hosts.have(trap.addr) || !community.check(trap.packet) { // Проверяем на валидный IP и OID + имеется ли host в zabbix + community
+			continue
+		}
+
+		if !cluster.master() { // Резервный узел хранит трапы на случай переключения
+			replay.push(trap)
+			continue
+		}
+
+		if !storm.allow(trap.addr, trap.packet.Variables[1].Value.(string)) { // Шторм трапов от источника
 			continue
 		}
 
@@ -49,13 +82,21 @@ func trapRawFilter() {
 
 		filteredTrap.time = trap.time
 		filteredTrap.addr = trap.addr
+		filteredTrap.transport = trap.transport
 		filteredTrap.packet = convertPacket(trap.packet.Variables)
 
+		if !dedup.check(filteredTrap) { // Повтор трапа или трап задержан до окончания окна dedup
+			continue
+		}
+
 		chTrapFiltered <- filteredTrap
 
-		if trap.packet.Version == snmp.Version3 {
+		switch trap.packet.Version {
+		case snmp.Version3:
 			stats.newFilteredTrap(3)
-		} else {
+		case snmp.Version1:
+			stats.newFilteredTrap(1)
+		default:
 			stats.newFilteredTrap(2)
 		}
 	}
@@ -76,12 +117,15 @@ func convertPacket(packet []snmp.SnmpPDU) []snmpPacket {
 			p.value = fmt.Sprintf("%v", v.Value)
 		}
 		p.oid = v.Name
-		if p.oid == ".1.3.6.1.6.3.1.1.4.1.0" {
+		if p.oid == oidSnmpTrapOID {
 			p.oid, p.value = p.value, p.oid // Меняем OID на значение самого трапа (стандартно индекс в слайсе [1])
 		}
 		trapOids.RLock()
 		p.name = trapOids.oid[p.oid].name
 		trapOids.RUnlock()
+		if p.name == "" && p.value == oidSnmpTrapOID { // Имя трапа из MIB
+			p.name = mibs.notification(p.oid)
+		}
 		p.asn1BER = v.Type
 		result = append(result, p)
 	}
@@ -89,8 +133,36 @@ func convertPacket(packet []snmp.SnmpPDU) []snmpPacket {
 	return result
 }
 
-func checkIP(addr net.UDPAddr) bool {
-	return true
+// Переменные SNMPv1 трапа в форме SNMPv2 (RFC3584 3.1): sysUpTime.0, snmpTrapOID.0, переменные трапа,
+// snmpTrapAddress.0, snmpTrapEnterprise.0
+func v1ToV2(packet snmp.SnmpPacket) []snmp.SnmpPDU {
+	enterprise := packet.Enterprise
+	if enterprise != "" && enterprise[0] != '.' {
+		enterprise = "." + enterprise
+	}
+
+	var trapOid string
+	if packet.GenericTrap == 6 { // enterpriseSpecific
+		trapOid = enterprise + ".0." + strconv.Itoa(packet.SpecificTrap)
+	} else {
+		trapOid = oidSnmpTraps + "." + strconv.Itoa(packet.GenericTrap+1)
+	}
+
+	result := make([]snmp.SnmpPDU, 0, len(packet.Variables)+4)
+	result = append(result,
+		snmp.SnmpPDU{Name: oidSysUpTime, Type: snmp.TimeTicks, Value: uint32(packet.Timestamp)},
+		snmp.SnmpPDU{Name: oidSnmpTrapOID, Type: snmp.ObjectIdentifier, Value: trapOid})
+	result = append(result, packet.Variables...)
+	result = append(result,
+		snmp.SnmpPDU{Name: oidSnmpTrapAddress, Type: snmp.IPAddress, Value: packet.AgentAddress},
+		snmp.SnmpPDU{Name: oidSnmpTrapEnterprise, Type: snmp.ObjectIdentifier, Value: enterprise})
+
+	return result
+}
+
+// Правила доступа по IP источника, community и пользователю SNMPv3
+func checkIP(addr net.UDPAddr, packet snmp.SnmpPacket) bool {
+	return access.check(addr, packet)
 }
 
 func checkOid(packet snmp.SnmpPDU) bool {
@@ -101,6 +173,20 @@ func checkOid(packet snmp.SnmpPDU) bool {
 	return have
 }
 
+func (o *trapOidType) name(oid string) string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.oid[oid].name
+}
+
+func (o *trapOidType) get(oid string) oidType {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.oid[oid]
+}
+
 func (c *communityType) check(packet snmp.SnmpPacket) bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	flapSuffix = ".flap" // Элемент данных флаппинга: имя трапа проблемы + суффикс
+)
+
+var (
+	flaps flapType
+)
+
+// Пара трапов проблема/восстановление для трапа из traps.txt
+type pairType struct {
+	problem  string // OID трапа проблемы
+	name     string // Имя трапа проблемы
+	recovery bool   // Трап восстановления
+	count    int    // Порог флаппинга, 0 - без проверки
+	window   time.Duration
+}
+
+// Состояние объекта пары: источник, трап проблемы и индекс
+type flapEntry struct {
+	pair        pairType
+	problem     bool        // Последнее состояние - проблема
+	seen        bool        // Состояние известно
+	transitions []time.Time // Переходы внутри окна
+	flapping    bool
+	suppressed  int
+	// Последний подавленный трап, отправляется по окончании флаппинга. Копируется по значению,
+	// срез packet общий с исходным трапом: переменные после конвертации не изменяются
+	last trapConverted
+}
+
+type flapType struct {
+	f map[string]*flapEntry
+
+	sync.Mutex
+}
+
+func init() {
+	flaps.f = make(map[string]*flapEntry)
+}
+
+// "5/60" - больше 5 переходов за 60 секунд
+func parseFlap(s string) (int, int, error) {
+	f := strings.SplitN(s, "/", 2)
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("wrong flap %q, need count/seconds", s)
+	}
+	count, err := strconv.Atoi(f[0])
+	if err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("wrong flap count %q", f[0])
+	}
+	window, err := strconv.Atoi(f[1])
+	if err != nil || window < 1 {
+		return 0, 0, fmt.Errorf("wrong flap window %q", f[1])
+	}
+	return count, window, nil
+}
+
+// Связывание трапов проблемы с трапами восстановления по OID или имени. Вызывается под Lock
+func (o *trapOidType) resolvePairs(problems []string) {
+	for _, oid := range problems {
+		cfg := o.oid[oid]
+		if cfg.recovery { // Уже указан как восстановление другой пары
+			log.Printf("ERROR: LoadOIDs %s: trap is already recovery of %s, option pair ignored\n", oid, cfg.pair)
+			continue
+		}
+
+		recovery := o.find(cfg.pair)
+		r, have := o.oid[recovery]
+		switch {
+		case !have:
+			log.Printf("ERROR: LoadOIDs %s: pair trap %s not found\n", oid, cfg.pair)
+		case recovery == oid:
+			log.Printf("ERROR: LoadOIDs %s: trap can't be pair of itself\n", oid)
+			have = false
+		case r.pair != "":
+			log.Printf("ERROR: LoadOIDs %s: pair trap %s already paired with %s\n", oid, recovery, r.pair)
+			have = false
+		}
+		if !have {
+			cfg.pair = ""
+			o.oid[oid] = cfg
+			continue
+		}
+
+		cfg.pair = recovery
+		o.oid[oid] = cfg
+		r.pair = oid
+		r.recovery = true
+		o.oid[recovery] = r
+	}
+}
+
+// OID трапа по OID или имени из traps.txt. Вызывается под Lock
+func (o *trapOidType) find(s string) string {
+	if s == "" {
+		return ""
+	}
+	if s[0] == '.' || s[0] >= '0' && s[0] <= '9' {
+		if s[0] != '.' {
+			s = "." + s
+		}
+		return s
+	}
+	for oid, cfg := range o.oid {
+		if cfg.name == s {
+			return oid
+		}
+	}
+	return ""
+}
+
+func (o *trapOidType) havePair(oid string) (pairType, bool) {
+	o.RLock()
+	defer o.RUnlock()
+
+	cfg := o.oid[oid]
+	if cfg.pair == "" {
+		return pairType{}, false
+	}
+
+	p := pairType{problem: oid, recovery: cfg.recovery}
+	if cfg.recovery {
+		p.problem = cfg.pair
+		cfg = o.oid[cfg.pair]
+	}
+	p.name = cfg.name
+	if p.name == "" {
+		p.name = mibs.notification(p.problem)
+	}
+	p.count = cfg.flapCount
+	p.window = time.Duration(cfg.flapWindow) * time.Second
+
+	return p, true
+}
+
+func flapKey(trap trapConverted, pair pairType) string {
+	return trap.addr.IP.String() + "\x00" + pair.problem + "\x00" + strings.Join(trap.index, "\x00")
+}
+
+// Учёт перехода проблема/восстановление. true - трап отправляется, report - начало флаппинга
+func (f *flapType) transition(trap trapConverted, pair pairType) (bool, []trapConverted) {
+	if pair.count == 0 {
+		return true, nil
+	}
+
+	now := time.Now()
+	key := flapKey(trap, pair)
+
+	f.Lock()
+	defer f.Unlock()
+
+	e, have := f.f[key]
+	if !have {
+		e = &flapEntry{}
+		f.f[key] = e
+	}
+	e.pair = pair
+
+	if !e.seen || e.problem == pair.recovery { // Повтор того же состояния переходом не считается
+		e.transitions = append(e.transitions, now)
+	}
+	e.seen = true
+	e.problem = !pair.recovery
+	e.prune(now)
+
+	if !e.flapping && len(e.transitions) <= pair.count {
+		return true, nil
+	}
+
+	stats.newFlappingTrap()
+	e.suppressed++
+	e.last = trap
+	if e.flapping {
+		return false, nil
+	}
+
+	e.flapping = true
+	if debug {
+		log.Printf("Flapping %s from %s: %d transitions\n", pair.name, trap.addr.IP.String(), len(e.transitions))
+	}
+	return false, []trapConverted{e.report(now)}
+}
+
+// Окончание флаппинга: отчёт и последнее состояние объекта. Удаление неактивных состояний
+func (f *flapType) expire() (result []trapConverted) {
+	now := time.Now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	for key, e := range f.f {
+		e.prune(now)
+		if e.flapping && len(e.transitions) <= e.pair.count {
+			e.flapping = false
+			result = append(result, e.report(now))
+			last := e.last
+			last.time = now
+			result = append(result, last)
+			e.suppressed = 0
+			e.last = trapConverted{}
+			continue
+		}
+		if !e.flapping && len(e.transitions) == 0 {
+			delete(f.f, key)
+		}
+	}
+
+	return
+}
+
+func (e *flapEntry) prune(now time.Time) {
+	i := 0
+	for i < len(e.transitions) && now.Sub(e.transitions[i]) > e.pair.window {
+		i++
+	}
+	e.transitions = e.transitions[i:]
+}
+
+// Трап элемента данных флаппинга: 1 - начало, 0 - окончание
+// Шаблон key не задаётся: ключ всегда имя.flap[индекс], подстановки шаблона трапа по полям флаппинга не вычислить
+func (e *flapEntry) report(now time.Time) (trap trapConverted) {
+	state := "0"
+	text := "flapping of " + e.pair.name + " stopped, suppressed " + strconv.Itoa(e.suppressed) + " traps"
+	if e.flapping {
+		state = "1"
+		text = "flapping of " + e.pair.name + ": " + strconv.Itoa(len(e.transitions)) + " transitions in " + e.pair.window.String()
+	}
+
+	trap.time = now
+	trap.addr = e.last.addr
+	trap.transport = e.last.transport
+	trap.name = e.pair.name + flapSuffix
+	trap.oid = e.pair.problem
+	trap.lastDigit = state
+	trap.ifIndex = e.last.ifIndex
+	trap.index = e.last.index
+	trap.host = e.last.host
+	trap.packet = []snmpPacket{
+		{name: "flapping", value: state},
+		{name: "transitions", value: strconv.Itoa(len(e.transitions))},
+		{name: "suppressed", value: strconv.Itoa(e.suppressed)},
+		{name: "text", value: text},
+	}
+
+	return
+}
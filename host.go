@@ -53,6 +53,19 @@ func (h *hostsType) idsByIP(addr net.UDPAddr) (ids []int) {
 	return ids
 }
 
+func (h *hostsType) idsByName(hostName string) (ids []int) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for i, z := range (*h).h {
+		if z.hostName == hostName {
+			ids = append(ids, i)
+		}
+	}
+
+	return ids
+}
+
 func (h *hostsType) have(ip net.UDPAddr) bool {
 	h.RLock()
 	defer h.RUnlock()
@@ -72,7 +85,7 @@ func (h *hostsType) have(ip net.UDPAddr) bool {
 func (h *hostsType) add(hostName string, hostIP net.UDPAddr, proxyName string, instance string) {
 	// Ключ по совокупности: hostName + hostIP + instance
 
-	proxies.add(proxyName)
+	proxies.add(proxyName, instance)
 
 	h.RLock()
 	for i := range (*h).h {
@@ -107,7 +120,7 @@ func (h *hostsType) add(hostName string, hostIP net.UDPAddr, proxyName string, i
 
 func (h *hostsType) newProxy(hostName string, proxyName string, instance string) error {
 
-	proxies.add(proxyName)
+	proxies.add(proxyName, instance)
 	have := false
 
 	h.RLock()
@@ -185,6 +198,19 @@ func (h *hostsType) haveProxy(proxy string) bool {
 	return false
 }
 
+func (h *hostsType) names(addr net.UDPAddr) (result []string) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, i := range (*h).h {
+		if i.hostIP.IP.Equal(addr.IP) {
+			result = append(result, i.hostName)
+		}
+	}
+
+	return
+}
+
 func (h *hostsType) hostNames(addr net.UDPAddr, proxy string) (result []string) {
 	h.RLock()
 	defer h.RUnlock()
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Индекс объекта трапа из traps.txt (index=entPhysicalIndex,hwAlarmEntry.index.2):
+// значение переменной, индекс экземпляра из OID переменной (имя.index) или его компонент (имя.index.N, с 1)
+type indexSpec struct {
+	name   string
+	suffix bool
+	pos    int
+}
+
+func parseIndexSpec(s string) ([]indexSpec, error) {
+	var result []indexSpec
+
+	for _, f := range strings.Split(s, ",") {
+		var spec indexSpec
+
+		p := strings.Split(strings.TrimSpace(f), ".")
+		spec.name = p[0]
+		if spec.name == "" {
+			return nil, fmt.Errorf("empty variable name in %q", f)
+		}
+		if len(p) > 1 {
+			if p[1] != "index" || len(p) > 3 {
+				return nil, fmt.Errorf("wrong index %q", f)
+			}
+			spec.suffix = true
+		}
+		if len(p) == 3 {
+			n, err := strconv.Atoi(p[2])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("wrong index position %q", f)
+			}
+			spec.pos = n
+		}
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
+
+// Значения индекса трапа. Без описания индекса - ifIndex, если есть
+func trapIndex(spec []indexSpec, p []snmpPacket, ifIndex string) []string {
+	if len(spec) == 0 {
+		if ifIndex != "" {
+			return []string{ifIndex}
+		}
+		return nil
+	}
+
+	result := make([]string, 0, len(spec))
+	for _, s := range spec {
+		result = append(result, s.value(p))
+	}
+
+	return result
+}
+
+func (s indexSpec) value(p []snmpPacket) string {
+	for _, i := range p {
+		if i.name != s.name {
+			continue
+		}
+		switch {
+		case !s.suffix:
+			return i.value
+		case s.pos == 0:
+			return i.index
+		}
+		if c := strings.Split(i.index, "."); s.pos <= len(c) {
+			return c[s.pos-1]
+		}
+		return ""
+	}
+
+	return ""
+}
+
+func equalIndex(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Параметры ключа Zabbix из индекса: "5", "1,\"a,b\""
+func indexKeyParams(index []string) string {
+	result := make([]string, 0, len(index))
+	for _, i := range index {
+		result = append(result, quoteKeyParam(i))
+	}
+	return strings.Join(result, ",")
+}
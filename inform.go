@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+const (
+	informWindow = 60 * time.Second // Окно подавления повторов InformRequest
+
+	oidUsmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+)
+
+var (
+	informs informsType
+
+	paramsDiscovery = &snmp.GoSNMP{ // Разбор запросов обнаружения engineID (SNMPv3 без аутентификации)
+		Version:       snmp.Version3,
+		SecurityModel: snmp.UserSecurityModel,
+		MsgFlags:      snmp.NoAuthNoPriv,
+	}
+)
+
+type informsType struct {
+	seen      map[string]time.Time // Ключ: IP + request-id
+	lastClean time.Time
+	unknownID uint32 // usmStatsUnknownEngineIDs
+
+	sync.Mutex
+}
+
+func init() {
+	informs.seen = make(map[string]time.Time)
+}
+
+// Повтор уже принятого InformRequest
+func (i *informsType) duplicate(packet *snmp.SnmpPacket, addr net.UDPAddr) bool {
+	key := addr.IP.String() + "/" + strconv.FormatUint(uint64(packet.RequestID), 10)
+	now := time.Now()
+
+	i.Lock()
+	defer i.Unlock()
+
+	if now.Sub(i.lastClean) > informWindow {
+		for k, t := range i.seen {
+			if now.Sub(t) > informWindow {
+				delete(i.seen, k)
+			}
+		}
+		i.lastClean = now
+	}
+
+	if t, have := i.seen[key]; have && now.Sub(t) <= informWindow {
+		return true
+	}
+	i.seen[key] = now
+
+	return false
+}
+
+// Ответ Response на InformRequest. Отправляется и на повторы - предыдущий ответ мог потеряться
+func ackInform(packet *snmp.SnmpPacket, reply replyFunc) error {
+	response := *packet
+	response.PDUType = snmp.GetResponse
+	response.Error = snmp.NoError
+	response.ErrorIndex = 0
+	response.MsgFlags &= snmp.AuthPriv // Ответ не должен требовать Report
+
+	if response.Version == snmp.Version3 {
+		usm, ok := packet.SecurityParameters.(*snmp.UsmSecurityParameters)
+		if !ok {
+			return fmt.Errorf("invalid security parameters in inform")
+		}
+		sp, err := responseUSM(usm, response.MsgFlags)
+		if err != nil {
+			return err
+		}
+		response.SecurityParameters = sp
+	}
+
+	b, err := response.MarshalMsg()
+	if err != nil {
+		return fmt.Errorf("can't marshal inform response: %w", err)
+	}
+
+	if err = reply(b); err != nil {
+		return fmt.Errorf("can't send inform response: %w", err)
+	}
+
+	stats.newInformAcked()
+
+	return nil
+}
+
+// Параметры USM ответа: ключи пользователя, наши snmpEngineBoots/Time и новая соль. Соль InformRequest
+// не используется: IV шифрования - boots, time и соль, ответ был бы зашифрован тем же потоком ключа
+func responseUSM(in *snmp.UsmSecurityParameters, flags snmp.SnmpV3MsgFlags) (*snmp.UsmSecurityParameters, error) {
+	boots, engineTime := engines.localTime()
+
+	sp := &snmp.UsmSecurityParameters{
+		AuthoritativeEngineID:    in.AuthoritativeEngineID,
+		AuthoritativeEngineBoots: boots,
+		AuthoritativeEngineTime:  engineTime,
+		UserName:                 in.UserName,
+		AuthenticationProtocol:   in.AuthenticationProtocol,
+		PrivacyProtocol:          in.PrivacyProtocol,
+		AuthenticationPassphrase: in.AuthenticationPassphrase,
+		PrivacyPassphrase:        in.PrivacyPassphrase,
+		SecretKey:                in.SecretKey,
+		PrivacyKey:               in.PrivacyKey,
+	}
+
+	if flags&snmp.AuthPriv == snmp.AuthPriv {
+		salt := make([]byte, 8)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("can't generate salt: %w", err)
+		}
+		if sp.PrivacyProtocol == snmp.DES { // RFC3414 8.1.1.1: snmpEngineBoots и случайная часть
+			binary.BigEndian.PutUint32(salt, boots)
+		}
+		sp.PrivacyParameters = salt
+	}
+
+	return sp, nil
+}
+
+// Report с нашим engineID на запрос обнаружения (RFC3414 3.2.3) перед отправкой SNMPv3 InformRequest
+func reportEngineID(msg []byte, reply replyFunc) error {
+	probe, err := paramsDiscovery.UnmarshalTrap(msg, false)
+	if err != nil {
+		return err
+	}
+	if probe.MsgFlags&snmp.Reportable == 0 {
+		return fmt.Errorf("discovery message without reportable flag")
+	}
+	usm, ok := probe.SecurityParameters.(*snmp.UsmSecurityParameters)
+	if !ok {
+		return fmt.Errorf("invalid security parameters in discovery message")
+	}
+
+	informs.Lock()
+	informs.unknownID++
+	counter := informs.unknownID
+	informs.Unlock()
+
+	localID := engines.localID()
+	boots, engineTime := engines.localTime()
+
+	report := &snmp.SnmpPacket{
+		Version:       snmp.Version3,
+		MsgFlags:      snmp.NoAuthNoPriv,
+		SecurityModel: snmp.UserSecurityModel,
+		SecurityParameters: &snmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    localID,
+			AuthoritativeEngineBoots: boots,
+			AuthoritativeEngineTime:  engineTime,
+			UserName:                 usm.UserName,
+			AuthenticationProtocol:   snmp.NoAuth,
+			PrivacyProtocol:          snmp.NoPriv,
+		},
+		ContextEngineID: localID,
+		ContextName:     probe.ContextName,
+		PDUType:         snmp.Report,
+		MsgID:           probe.MsgID,
+		RequestID:       probe.RequestID,
+		MsgMaxSize:      rxBufSize,
+		Variables: []snmp.SnmpPDU{
+			{Name: oidUsmStatsUnknownEngineIDs, Type: snmp.Counter32, Value: counter},
+		},
+	}
+
+	b, err := report.MarshalMsg()
+	if err != nil {
+		return fmt.Errorf("can't marshal report: %w", err)
+	}
+
+	return reply(b)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+// Ответ на InformRequest с шифрованием: новая соль и наши boots/time, ответ расшифровывается
+func TestAckInformAuthPriv(t *testing.T) {
+	const localID = "\x80\x00\x1f\x88\x04test"
+
+	engines.Lock()
+	engines.local, engines.boots = localID, 7
+	engines.Unlock()
+
+	for _, priv := range []snmp.SnmpV3PrivProtocol{snmp.AES, snmp.DES} {
+		user := func() *snmp.UsmSecurityParameters {
+			return &snmp.UsmSecurityParameters{
+				AuthoritativeEngineID:    localID,
+				UserName:                 "user",
+				AuthenticationProtocol:   snmp.SHA,
+				AuthenticationPassphrase: "authpassword",
+				PrivacyProtocol:          priv,
+				PrivacyPassphrase:        "privpassword",
+			}
+		}
+		params := &snmp.GoSNMP{
+			Version:            snmp.Version3,
+			SecurityModel:      snmp.UserSecurityModel,
+			MsgFlags:           snmp.AuthPriv,
+			SecurityParameters: user(),
+			Logger:             snmp.NewLogger(nil),
+		}
+
+		sender := user()
+		sender.AuthoritativeEngineBoots = 7
+		sender.AuthoritativeEngineTime = 100
+		sender.PrivacyParameters = []byte{0, 0, 0, 7, 1, 2, 3, 4}
+		// gosnmp локализует ключи только при разборе сообщения, ошибка разбора пустого сообщения ожидаема
+		_, _ = params.UnmarshalTrap(nil, false)
+		receiver := params.SecurityParameters.(*snmp.UsmSecurityParameters)
+		sender.SecretKey, sender.PrivacyKey = receiver.SecretKey, receiver.PrivacyKey
+		inform := &snmp.SnmpPacket{
+			Version:            snmp.Version3,
+			MsgFlags:           snmp.AuthPriv | snmp.Reportable,
+			SecurityModel:      snmp.UserSecurityModel,
+			SecurityParameters: sender,
+			ContextEngineID:    localID,
+			PDUType:            snmp.InformRequest,
+			MsgID:              1,
+			RequestID:          2,
+			MsgMaxSize:         rxBufSize,
+			Variables:          []snmp.SnmpPDU{{Name: oidSnmpTrapOID, Type: snmp.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"}},
+		}
+
+		msg, err := inform.MarshalMsg()
+		if err != nil {
+			t.Fatalf("%v: marshal inform: %v", priv, err)
+		}
+		packet, err := params.UnmarshalTrap(msg, false)
+		if err != nil {
+			t.Fatalf("%v: unmarshal inform: %v", priv, err)
+		}
+
+		var reply []byte
+		if err := ackInform(packet, func(b []byte) error { reply = b; return nil }); err != nil {
+			t.Fatalf("%v: ack: %v", priv, err)
+		}
+
+		response, err := params.UnmarshalTrap(reply, false)
+		if err != nil {
+			t.Fatalf("%v: unmarshal response: %v", priv, err)
+		}
+		sp := response.SecurityParameters.(*snmp.UsmSecurityParameters)
+		if response.PDUType != snmp.GetResponse || response.RequestID != 2 || len(response.Variables) != 1 {
+			t.Errorf("%v: wrong response %+v", priv, response)
+		}
+		if bytes.Equal(sp.PrivacyParameters, sender.PrivacyParameters) {
+			t.Errorf("%v: response reuses inform salt %x", priv, sp.PrivacyParameters)
+		}
+		if sp.AuthoritativeEngineBoots != 7 {
+			t.Errorf("%v: response boots %d, want 7", priv, sp.AuthoritativeEngineBoots)
+		}
+	}
+}
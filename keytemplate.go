@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Подстановки шаблона ключа, кроме имён переменных трапа
+const (
+	keyFieldName      = "name"      // Имя трапа из traps.txt
+	keyFieldLastDigit = "lastdigit" // Последняя цифра OID трапа или значение трапа "потери"
+	keyFieldIP        = "ip"        // IP источника
+	keyFieldHost      = "host"      // Имя хоста в Zabbix
+	keyFieldIfIndex   = "ifIndex"
+	keyFieldIndex     = "index"  // Индекс объекта трапа (index= в traps.txt), значения через ","
+	keyFieldOid       = "oid"    // OID трапа
+	keyFieldCount     = "count"  // Количество повторов (dedup)
+	keyFieldVars      = "vars"   // Переменные трапа в формате snmptrapd, только для шаблона значения
+	keyIndexSuffix    = ".index" // {имя.index} - индекс экземпляра переменной
+)
+
+// Встроенные подстановки, остальные - имена переменных трапа
+var keyFields = map[string]bool{
+	keyFieldName:      true,
+	keyFieldLastDigit: true,
+	keyFieldIP:        true,
+	keyFieldHost:      true,
+	keyFieldIfIndex:   true,
+	keyFieldIndex:     true,
+	keyFieldOid:       true,
+	keyFieldCount:     true,
+	keyFieldVars:      true,
+}
+
+// Часть шаблона ключа: текст или подстановка
+type keyPart struct {
+	text  string
+	field string
+	quote bool // Подстановка внутри [...] - значение экранируется как параметр ключа Zabbix
+}
+
+// Шаблон ключа элемента данных или значения из traps.txt: bgp.peer.state[{bgpPeerRemoteAddr}]
+type keyTemplate struct {
+	text  string
+	parts []keyPart
+}
+
+// Шаблон ключа: проверяются скобки параметров, значения внутри [...] экранируются
+func parseKeyTemplate(s string) (*keyTemplate, error) {
+	return parseTemplate(s, true)
+}
+
+// Шаблон значения элемента данных: произвольный текст с подстановками
+func parseTextTemplate(s string) (*keyTemplate, error) {
+	return parseTemplate(s, false)
+}
+
+// {{ и }} - символы { и } в тексте шаблона
+func parseTemplate(s string, key bool) (*keyTemplate, error) {
+	k := &keyTemplate{text: s}
+	depth := 0
+
+	addText := func(c byte) {
+		if n := len(k.parts); n > 0 && k.parts[n-1].field == "" {
+			k.parts[n-1].text += string(c)
+		} else {
+			k.parts = append(k.parts, keyPart{text: string(c)})
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case (c == '{' || c == '}') && i+1 < len(s) && s[i+1] == c:
+			addText(c)
+			i += 2
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed placeholder at %d", i)
+			}
+			field := s[i+1 : i+end]
+			if field == "" || strings.ContainsAny(field, "{[]") {
+				return nil, fmt.Errorf("wrong placeholder %q", s[i:i+end+1])
+			}
+			if key && field == keyFieldVars {
+				return nil, fmt.Errorf("placeholder {%s} not allowed in key", field)
+			}
+			k.parts = append(k.parts, keyPart{field: field, quote: key && depth > 0})
+			i += end + 1
+		case c == '}':
+			return nil, fmt.Errorf("unexpected } at %d", i)
+		default:
+			switch {
+			case !key:
+			case c == '[':
+				depth++
+			case c == ']':
+				if depth--; depth < 0 {
+					return nil, fmt.Errorf("unexpected ] at %d", i)
+				}
+			}
+			addText(c)
+			i++
+		}
+	}
+
+	if !key {
+		return k, nil
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unclosed [")
+	}
+	if len(k.parts) == 0 || k.parts[0].field == "" && strings.HasPrefix(k.parts[0].text, "[") {
+		return nil, fmt.Errorf("empty key name")
+	}
+
+	return k, nil
+}
+
+// Проверка подстановок при загрузке: опечатка в имени иначе даёт пустое значение в каждом трапе
+func (k *keyTemplate) check() error {
+	for _, p := range k.parts {
+		if p.field == "" || keyFields[p.field] {
+			continue
+		}
+		if !knownVar(strings.TrimSuffix(p.field, keyIndexSuffix)) {
+			return fmt.Errorf("unknown placeholder {%s}", p.field)
+		}
+	}
+	return nil
+}
+
+// Имя переменной из vars.txt, MIB или поля, которое задают правила и сценарии
+func knownVar(name string) bool {
+	return varOids.has(name) || mibs.has(name) || rules.sets(name) || scripts.sets(name)
+}
+
+// Ключ или значение для трапа и хоста. Отсутствующие переменные подставляются пустой строкой
+func (k *keyTemplate) render(trap trapToSend, hostname string) string {
+	var b strings.Builder
+
+	for _, p := range k.parts {
+		if p.field == "" {
+			b.WriteString(p.text)
+			continue
+		}
+		v := trap.field(p.field, hostname)
+		switch {
+		case p.field == keyFieldIndex && p.quote:
+			v = indexKeyParams(trap.index)
+		case p.quote:
+			v = quoteKeyParam(v)
+		}
+		b.WriteString(v)
+	}
+
+	return b.String()
+}
+
+func (trap trapToSend) field(field, hostname string) string {
+	switch field {
+	case keyFieldName:
+		return trap.name
+	case keyFieldLastDigit:
+		return trap.lastDigit
+	case keyFieldIP:
+		return trap.addr.IP.String()
+	case keyFieldHost:
+		return hostname
+	case keyFieldIfIndex:
+		return trap.ifIndex
+	case keyFieldIndex:
+		return strings.Join(trap.index, ",")
+	case keyFieldOid:
+		return trap.oid
+	case keyFieldCount:
+		return strconv.Itoa(trap.count)
+	case keyFieldVars:
+		return snmptrapdVars(trap.packet)
+	}
+
+	name := strings.TrimSuffix(field, keyIndexSuffix)
+	for _, i := range trap.packet {
+		if i.name != name {
+			continue
+		}
+		if name != field {
+			return i.index
+		}
+		return i.value
+	}
+
+	return ""
+}
+
+// Параметр ключа Zabbix в кавычках, если содержит спецсимволы
+func quoteKeyParam(s string) string {
+	if !strings.ContainsAny(s, `,[]"`) && !strings.HasPrefix(s, " ") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+const (
+	rxBufSize      = 65535
+	tcpMaxMsgSize  = 1 << 20         // Максимальный размер SNMP сообщения по TCP
+	tcpIdleTimeout = 5 * time.Minute // Закрываем TCP соединение без сообщений
+	defaultListen  = "udp://0.0.0.0:162"
+)
+
+// Транспорт, по которому принят трап: в формате snmptrapd
+const (
+	transportUDP = "UDP"
+	transportTCP = "TCP"
+)
+
+var (
+	listeners listenersType
+
+	paramsCommunity = &snmp.GoSNMP{Version: snmp.Version2c} // Разбор SNMPv1/v2c трапов
+
+	errDiscovery = errors.New("engine ID discovery")
+)
+
+// Отправка ответа (Response, Report) отправителю трапа
+type replyFunc func([]byte) error
+
+type listenerStatType struct {
+	Received uint64 `json:"received"`
+	Dropped  uint64 `json:"dropped"`
+	Error    string `json:"error,omitempty"` // Приёмник не запустился
+}
+
+type listenersType struct {
+	addrs []string
+	l     map[string]*listenerStatType
+
+	sync.RWMutex
+}
+
+func init() {
+	listeners.l = make(map[string]*listenerStatType)
+}
+
+// Список адресов приёма из cred.json. Применяется при старте программы
+func (l *listenersType) load(addrs []string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(addrs) == 0 {
+		addrs = []string{defaultListen}
+	}
+
+	if l.addrs != nil {
+		if strings.Join(l.addrs, ",") != strings.Join(addrs, ",") {
+			log.Println("Listener: list of listen addresses changed, restart required")
+		}
+		return
+	}
+
+	l.addrs = addrs
+}
+
+// Запуск всех приёмников. Ошибка приёмника пишется в лог, остальные продолжают работу.
+// Возвращает ошибку, когда не работает ни один
+func (l *listenersType) listen() error {
+	l.Lock()
+	addrs := l.addrs
+	for _, i := range addrs {
+		l.l[i] = &listenerStatType{}
+	}
+	l.Unlock()
+
+	chErr := make(chan error, len(addrs))
+
+	for _, i := range addrs {
+		go func(addr string) {
+			err := listen(addr)
+			log.Printf("ERROR: listener %s: %+v\n", addr, err)
+			l.failed(addr, err)
+			chErr <- err
+		}(i)
+	}
+
+	for range addrs {
+		<-chErr
+	}
+
+	return errors.New("no listeners running")
+}
+
+func (l *listenersType) failed(name string, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if s, have := l.l[name]; have {
+		s.Error = err.Error()
+	}
+}
+
+// "udp://0.0.0.0:162", "tcp://[::]:162", "10.0.0.1:1162" (по умолчанию UDP)
+func listen(addr string) error {
+	network, hostPort := "udp", addr
+	if s := strings.SplitN(addr, "://", 2); len(s) == 2 {
+		network, hostPort = s[0], s[1]
+	}
+	network = listenNetwork(network, hostPort)
+
+	log.Printf("Listener: start %s\n", addr)
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		return listenUDP(addr, network, hostPort)
+	case "tcp", "tcp4", "tcp6":
+		return listenTCP(addr, network, hostPort)
+	}
+
+	return fmt.Errorf("unknown network %s", network)
+}
+
+// Для адреса IPv4 или IPv6 - сеть только этого семейства. В Linux "[::]" в сети udp/tcp принимает
+// и IPv4, и 0.0.0.0 на том же порту уже не открыть. ":162" - оба семейства одним приёмником
+func listenNetwork(network, hostPort string) string {
+	if network != "udp" && network != "tcp" {
+		return network
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return network
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	}
+	return network + "6" // IPV6_V6ONLY
+}
+
+func (l *listenersType) newTrap(name string, dropped bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if s, have := l.l[name]; have {
+		if dropped {
+			s.Dropped++
+		} else {
+			s.Received++
+		}
+	}
+}
+
+func (l *listenersType) stat() map[string]listenerStatType {
+	l.RLock()
+	defer l.RUnlock()
+
+	result := make(map[string]listenerStatType, len(l.l))
+	for i, s := range l.l {
+		result[i] = *s
+	}
+
+	return result
+}
+
+// Приём трапов по UDP. Вместо snmp.TrapListener т.к. он поддерживает только одного пользователя SNMPv3
+func listenUDP(name, network, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, rxBufSize)
+
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil { // Пауза, чтобы постоянная ошибка не забивала лог и процессор
+			log.Printf("Listener: error in read %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		msg := make([]byte, n) // Значения переменных могут ссылаться на буфер
+		copy(msg, buf[:n])
+
+		handleMessage(name, transportUDP, msg, remote, func(b []byte) error {
+			_, err := conn.WriteToUDP(b, remote)
+			return err
+		})
+	}
+}
+
+// Приём трапов по TCP (RFC3430)
+func listenTCP(name, network, addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.ListenTCP(network, tcpAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.AcceptTCP()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Listener: error in accept %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go handleTCP(name, conn)
+	}
+}
+
+// Сообщения в TCP потоке идут подряд, граница определяется по длине BER
+func handleTCP(name string, conn *net.TCPConn) {
+	defer conn.Close()
+
+	ra := conn.RemoteAddr().(*net.TCPAddr)
+	remote := &net.UDPAddr{IP: ra.IP, Port: ra.Port, Zone: ra.Zone}
+	reply := func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+
+		msg, err := readBER(r)
+		if err != nil {
+			if err != io.EOF && debug {
+				log.Printf("Listener: TCP connection from %s closed: %v\n", remote.IP.String(), err)
+			}
+			return
+		}
+
+		handleMessage(name, transportTCP, msg, remote, reply)
+	}
+}
+
+// Одно BER сообщение из потока целиком (тег, длина и содержимое)
+func readBER(r *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0] != byte(snmp.Sequence) {
+		return nil, errBER
+	}
+
+	l := int(head[1])
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errBER
+		}
+		head = head[:2+n]
+		if _, err := io.ReadFull(r, head[2:]); err != nil {
+			return nil, err
+		}
+		l = 0
+		for _, c := range head[2:] {
+			l = l<<8 | int(c)
+		}
+	}
+	if l > tcpMaxMsgSize {
+		return nil, fmt.Errorf("message size %d exceeds %d", l, tcpMaxMsgSize)
+	}
+
+	msg := make([]byte, len(head)+l)
+	copy(msg, head)
+	if _, err := io.ReadFull(r, msg[len(head):]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func handleMessage(name, transport string, msg []byte, remote *net.UDPAddr, reply replyFunc) {
+	packet, err := unmarshalTrap(msg, *remote)
+	if err == errDiscovery {
+		if err := reportEngineID(msg, reply); err != nil && debug {
+			log.Printf("Listener: discovery from %s: %v\n", remote.IP.String(), err)
+		}
+		return
+	}
+	if err != nil { // Неразобранное сообщение - в карантин, как трапы, не прошедшие проверку
+		listeners.newTrap(name, true)
+		stats.newMalformedTrap(remote.IP.String(), reasonMalformed)
+		quarantine.addMalformed(msg, *remote, err)
+		if debug {
+			log.Printf("Listener: trap from %s dropped: %v\n", remote.IP.String(), err)
+		}
+		return
+	}
+
+	listeners.newTrap(name, false)
+
+	if packet.PDUType == snmp.InformRequest && access.allows(*remote, *packet) { // Запрещённый InformRequest не подтверждается
+		if err := ackInform(packet, reply); err != nil {
+			log.Printf("Listener: inform from %s: %v\n", remote.IP.String(), err)
+		}
+		if informs.duplicate(packet, *remote) {
+			stats.newInformDuplicate()
+			return
+		}
+	}
+
+	myTrapHandler(packet, remote, transport, msg)
+}
+
+func unmarshalTrap(msg []byte, addr net.UDPAddr) (*snmp.SnmpPacket, error) {
+	version, err := snmpVersion(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != snmp.Version3 {
+		return paramsCommunity.UnmarshalTrap(msg, false)
+	}
+
+	engineID, userName, err := usmPeek(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if engineID == "" {
+		return nil, errDiscovery
+	}
+
+	local := engineID == engines.localID()
+	if !local { // Трап подписан engineID отправителя, InformRequest - нашим
+		if err := engines.check(addr, engineID); err != nil {
+			return nil, err
+		}
+	}
+
+	params, user, err := usmUsers.get(userName, engineID)
+	if err != nil {
+		return nil, err
+	}
+
+	packet, err := params.UnmarshalTrap(msg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if packet.MsgFlags&snmp.AuthPriv < user.msgFlags { // Уровень безопасности ниже настроенного для пользователя
+		return nil, fmt.Errorf("unsupported security level %d for USM user %q", packet.MsgFlags&snmp.AuthPriv, userName)
+	}
+
+	if user.msgFlags != snmp.NoAuthNoPriv { // Ключи для нашего engineID тоже кэшируются: иначе их локализует каждый InformRequest
+		usmUsers.keep(userName, engineID, params)
+		if !local { // Наш engineID не запоминается за отправителем InformRequest
+			engines.learnFrom(addr, engineID)
+		}
+	}
+
+	return packet, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"container/heap"
+	"strings"
 	"sync"
 	"time"
 )
@@ -9,13 +11,59 @@ var (
 	waitQueue queueToWait
 )
 
+// Ожидающий трап "потери" в очереди
+type waitItem struct {
+	trap trapConverted
+	key  string
+	pos  int // Позиция в куче
+}
+
+// Куча ожидающих трапов по времени отправки
+type waitHeap []*waitItem
+
+// Очередь трапов "потери": поиск по ключу (источник, имя, индекс) и ближайший по времени трап из кучи
 type queueToWait struct {
-	t []trapConverted
+	m map[string]*waitItem
+	h waitHeap
+
 	sync.RWMutex
 }
 
 func init() {
-	waitQueue.t = make([]trapConverted, 0)
+	waitQueue.m = make(map[string]*waitItem)
+}
+
+func (h waitHeap) Len() int           { return len(h) }
+func (h waitHeap) Less(i, j int) bool { return h[i].trap.time.Before(h[j].trap.time) }
+
+func (h waitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *waitHeap) Push(x interface{}) {
+	item := x.(*waitItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *waitHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// Ключ сопоставления трапа "потери": источник, имя трапа и индекс объекта
+func waitKey(ip, name string, index []string) string {
+	return ip + "\x00" + name + "\x00" + strings.Join(index, "\x00")
+}
+
+func (trap trapConverted) waitKey() string {
+	return waitKey(trap.addr.IP.String(), trap.name, trap.index)
 }
 
 // Запускать в 1 поток
@@ -33,118 +81,133 @@ func trapLost() {
 				return
 			}
 
-			waitQueue.checkAndPush(trap)
+			waitQueue.correlate(trap)
 			waitQueue.checkAndPull()
 		case <-ticker.C:
+			for _, i := range flaps.expire() { // Окончание флаппинга: отчёт и последнее состояние
+				waitQueue.forward(i)
+			}
 			waitQueue.checkAndPull()
+			waitStore.flush()
+			if waitStore.due() {
+				waitQueue.save()
+			}
 		}
 	}
 
 }
 
-func (t *queueToWait) push(unknownValue string, waitTime int, trap trapConverted) {
-	t.Lock()
-	defer t.Unlock()
-
-	trap.time = time.Now().Add(time.Duration(waitTime) * time.Second)
-	trap.lastDigit = unknownValue
-	t.t = append(t.t, trap)
-}
-
-func (t *queueToWait) have(trap trapConverted) (int, bool) {
-	t.RLock()
-	defer t.RUnlock()
+// Трапы пар проблема/восстановление приходят только сюда и отправляются после проверки на флаппинг
+func (t *queueToWait) correlate(trap trapConverted) {
+	pair, have := trapOids.havePair(trap.oid)
+	if !have {
+		t.checkAndPush(trap)
+		return
+	}
 
-	for i, z := range t.t {
-		if z.addr.IP.Equal(trap.addr.IP) && z.name == trap.name && z.ifIndex == trap.ifIndex {
-			return i, true
-		}
+	if pair.recovery { // Восстановление отменяет ожидающую проблему
+		t.cancel(trap, pair)
 	}
 
-	return 0, false
+	send, report := flaps.transition(trap, pair)
+	for _, i := range report {
+		chTrapConverted <- i
+	}
+	if send {
+		t.forward(trap)
+	}
 }
 
-func (t *queueToWait) checkAndPush(trap trapConverted) {
-	if i, have := t.have(trap); have {
-		if unknownValue, waitTime, have := trapOids.haveWait(trap.oid); !have {
-			t.remove(i)
-		} else {
-			t.Lock()
-			t.t[i].time = time.Now().Add(time.Duration(waitTime) * time.Second) // обновляем время
-			t.t[i].lastDigit = unknownValue
-			t.Unlock()
-		}
-	} else {
-		if unknownValue, waitTime, have := trapOids.haveWait(trap.oid); have {
-			t.push(unknownValue, waitTime, trap)
-		}
-	}
+func (t *queueToWait) forward(trap trapConverted) {
+	chTrapConverted <- trap
+	t.checkAndPush(trap)
 }
 
-func (t *queueToWait) checkAndPull() {
+func (t *queueToWait) cancel(trap trapConverted, pair pairType) {
+	t.Lock()
+	defer t.Unlock()
 
-	for i := 0; i < t.len(); i++ { // range нельзя!!!
-		if t.checkBefore(i) {
-			t.setTimeNow(i)
-			t.sendToChan(i)
-			t.remove(i)
-			i--
-		}
+	if item, have := t.m[waitKey(trap.addr.IP.String(), pair.name, trap.index)]; have && item.trap.oid == pair.problem {
+		t.remove(item)
 	}
 }
 
-func (t *queueToWait) sendToChan(i int) {
-	t.RLock()
-	defer t.RUnlock()
+// Добавление трапа с ожиданием или обновление времени ожидания. Повтор трапа без ожидания удаляет его из очереди
+func (t *queueToWait) checkAndPush(trap trapConverted) {
+	unknownValue, waitTime, wait := trapOids.haveWait(trap.oid)
+	key := trap.waitKey()
+
+	t.Lock()
+	defer t.Unlock()
 
-	// if len(t.t) == 0 {
-	// 	return
-	// }
+	item, have := t.m[key]
+	switch {
+	case have && !wait:
+		t.remove(item)
+	case have:
+		item.trap.time = time.Now().Add(time.Duration(waitTime) * time.Second) // обновляем время
+		item.trap.lastDigit = unknownValue
+		heap.Fix(&t.h, item.pos)
+		waitStore.set(item.trap)
+	case wait:
+		trap.time = time.Now().Add(time.Duration(waitTime) * time.Second)
+		trap.lastDigit = unknownValue
+		t.insert(key, trap)
+		waitStore.set(trap)
+	}
+}
 
-	chTrapConverted <- t.t[i]
+// Отправка трапов с истёкшим временем ожидания
+func (t *queueToWait) checkAndPull() {
+	for _, trap := range t.pull(time.Now()) {
+		chTrapConverted <- trap
 
-	stats.newLostTrap()
+		stats.newLostTrap()
+	}
 }
 
-func (t *queueToWait) setTimeNow(i int) {
+func (t *queueToWait) pull(now time.Time) (result []trapConverted) {
 	t.Lock()
 	defer t.Unlock()
 
-	// if len(t.t) == 0 {
-	// 	return
-	// }
+	for len(t.h) > 0 && t.h[0].trap.time.Before(now) {
+		item := t.h[0]
+		t.remove(item)
+		item.trap.time = now
+		result = append(result, item.trap)
+	}
 
-	t.t[i].time = time.Now()
+	return
 }
 
 func (t *queueToWait) len() int {
 	t.RLock()
 	defer t.RUnlock()
 
-	return len(t.t)
+	return len(t.h)
 }
 
-func (t *queueToWait) checkBefore(i int) bool {
-	t.RLock()
-	defer t.RUnlock()
-
-	// if len(t.t) == 0 {
-	// 	return false
-	// }
-
-	return t.t[i].time.Before(time.Now())
+// Копия очереди для снимка. Вызывается под блокировкой
+func (t *queueToWait) list() []trapConverted {
+	result := make([]trapConverted, 0, len(t.h))
+	for _, item := range t.h {
+		result = append(result, item.trap)
+	}
+	return result
 }
 
-func (t *queueToWait) remove(i int) {
-	t.Lock()
-	defer t.Unlock()
-
-	// if len(t.t) == 0 {
-	// 	return
-	// }
+// Вызывается под Lock
+func (t *queueToWait) insert(key string, trap trapConverted) {
+	item := &waitItem{trap: trap, key: key}
+	t.m[key] = item
+	heap.Push(&t.h, item)
+}
 
-	(*t).t[i] = (*t).t[len(t.t)-1]
-	t.t = (*t).t[:len(t.t)-1]
+// Вызывается под Lock
+func (t *queueToWait) remove(item *waitItem) {
+	waitStore.del(item.trap)
+	heap.Remove(&t.h, item.pos)
+	delete(t.m, item.key)
 }
 
 func (o *trapOidType) haveWait(oid string) (string, int, bool) {
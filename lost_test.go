@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testLinkDown = ".1.3.6.1.6.3.1.1.5.3"
+	testLinkUp   = ".1.3.6.1.6.3.1.1.5.4"
+)
+
+var testQueueSizes = []int{1000, 10000, 100000}
+
+const testFlushEvery = 1000 // Операций между записями журнала: в работе журнал пишется раз в секунду
+
+// linkDown ждёт 60 секунд, linkUp - его восстановление. Прежний traps.txt возвращается после теста
+func setupWaitTest(tb testing.TB) {
+	trapOids.Lock()
+	saved := trapOids.oid
+	trapOids.oid = map[string]oidType{
+		testLinkDown: {name: "linkDown", unknownValue: "1", wait: 60, pair: testLinkUp},
+		testLinkUp:   {name: "linkUp", pair: testLinkDown, recovery: true},
+	}
+	trapOids.Unlock()
+
+	tb.Cleanup(func() {
+		trapOids.Lock()
+		trapOids.oid = saved
+		trapOids.Unlock()
+	})
+}
+
+// Сохранение очереди на диск во временный каталог, как с --waitqueue
+func setupWaitStore(b *testing.B) {
+	saved := fileWaitQueue
+	fileWaitQueue = filepath.Join(b.TempDir(), "waitqueue.json")
+
+	b.Cleanup(func() {
+		waitStore.Lock()
+		if waitStore.log != nil {
+			waitStore.log.Close()
+		}
+		waitStore.log, waitStore.w, waitStore.pending, waitStore.logged = nil, nil, nil, 0
+		waitStore.Unlock()
+		fileWaitQueue = saved
+	})
+}
+
+// Варианты бенчмарка: очередь только в памяти и с журналом на диске
+func runWaitBenchmark(b *testing.B, bench func(b *testing.B, n int, persist bool)) {
+	for _, n := range testQueueSizes {
+		for _, persist := range []bool{false, true} {
+			name := fmt.Sprintf("%d/memory", n)
+			if persist {
+				name = fmt.Sprintf("%d/journal", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				if persist {
+					setupWaitStore(b)
+				}
+				bench(b, n, persist)
+			})
+		}
+	}
+}
+
+// Запись журнала по ходу бенчмарка входит в измеряемое время
+func flushWaitStore(i int, persist bool) {
+	if persist && (i+1)%testFlushEvery == 0 {
+		waitStore.flush()
+	}
+}
+
+// Трап от i-го источника
+func testWaitTrap(i int, oid, name string) trapConverted {
+	return trapConverted{
+		addr:  net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 162},
+		name:  name,
+		oid:   oid,
+		index: []string{"1"},
+	}
+}
+
+// Очередь из n трапов linkDown
+func newTestQueue(n int) *queueToWait {
+	q := &queueToWait{m: make(map[string]*waitItem, n)}
+	for i := 0; i < n; i++ {
+		q.checkAndPush(testWaitTrap(i, testLinkDown, "linkDown"))
+	}
+	return q
+}
+
+// correlate отправляет парные трапы в chTrapConverted
+func drainConverted() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-chTrapConverted:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Карта и куча описывают одни и те же элементы, позиции в куче верные, куча упорядочена
+func checkWaitQueue(t *testing.T, q *queueToWait) {
+	t.Helper()
+
+	q.RLock()
+	defer q.RUnlock()
+
+	if len(q.m) != len(q.h) {
+		t.Fatalf("map has %d items, heap %d", len(q.m), len(q.h))
+	}
+	for i, item := range q.h {
+		if item.pos != i {
+			t.Fatalf("item %s: pos %d, index in heap %d", item.key, item.pos, i)
+		}
+		if q.m[item.key] != item {
+			t.Fatalf("item %s is not in map", item.key)
+		}
+		if i > 0 && q.h[i].trap.time.Before(q.h[(i-1)/2].trap.time) {
+			t.Fatalf("heap order broken at %d", i)
+		}
+	}
+}
+
+func TestWaitQueueOrder(t *testing.T) {
+	setupWaitTest(t)
+	defer drainConverted()()
+
+	const n = 2000
+	rnd := rand.New(rand.NewSource(1))
+	base := time.Now()
+
+	q := &queueToWait{m: make(map[string]*waitItem, n)}
+	q.Lock()
+	for i := 0; i < n; i++ {
+		trap := testWaitTrap(i, testLinkDown, "linkDown")
+		trap.time = base.Add(time.Duration(rnd.Intn(3600)) * time.Second)
+		q.insert(trap.waitKey(), trap)
+	}
+	q.Unlock()
+	checkWaitQueue(t, q)
+
+	cancelled := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		switch rnd.Intn(4) {
+		case 0: // Восстановление отменяет ожидание
+			q.correlate(testWaitTrap(i, testLinkUp, "linkUp"))
+			cancelled[testWaitTrap(i, testLinkDown, "linkDown").waitKey()] = true
+		case 1: // Повтор проблемы продлевает ожидание
+			q.correlate(testWaitTrap(i, testLinkDown, "linkDown"))
+		}
+	}
+	q.cancel(testWaitTrap(n+1, testLinkUp, "linkUp"), pairType{name: "linkDown", problem: testLinkDown}) // Нет в очереди
+	checkWaitQueue(t, q)
+
+	expire := make(map[string]time.Time)
+	q.RLock()
+	for key, item := range q.m {
+		expire[key] = item.trap.time
+	}
+	q.RUnlock()
+	for key := range cancelled {
+		if _, have := expire[key]; have {
+			t.Fatalf("cancelled trap %s is still waiting", key)
+		}
+	}
+
+	// Частичная выборка возвращает только истёкшие трапы
+	border := base.Add(30 * time.Minute)
+	first := q.pull(border)
+	checkWaitQueue(t, q)
+	for _, trap := range first {
+		if !expire[trap.waitKey()].Before(border) {
+			t.Fatalf("trap %s pulled before its time", trap.waitKey())
+		}
+	}
+
+	pulled := append(first, q.pull(base.Add(24*time.Hour))...)
+	if len(pulled) != len(expire) {
+		t.Fatalf("pulled %d traps, want %d", len(pulled), len(expire))
+	}
+	if q.len() != 0 {
+		t.Fatalf("queue has %d traps after pull", q.len())
+	}
+	for i := 1; i < len(pulled); i++ {
+		if expire[pulled[i].waitKey()].Before(expire[pulled[i-1].waitKey()]) {
+			t.Fatalf("trap %d pulled out of expiry order", i)
+		}
+	}
+}
+
+// Добавление новых трапов в очередь из n трапов
+func BenchmarkWaitQueueInsert(b *testing.B) {
+	setupWaitTest(b)
+
+	runWaitBenchmark(b, func(b *testing.B, n int, persist bool) {
+		q := newTestQueue(n)
+		waitStore.flush()
+		traps := make([]trapConverted, b.N)
+		for i := range traps {
+			traps[i] = testWaitTrap(n+i, testLinkDown, "linkDown")
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			q.checkAndPush(traps[i])
+			flushWaitStore(i, persist)
+		}
+		waitStore.flush()
+	})
+}
+
+// Восстановление отменяет ожидающую проблему, повтор проблемы возвращает её в очередь
+func BenchmarkWaitQueueCorrelate(b *testing.B) {
+	setupWaitTest(b)
+	defer drainConverted()()
+
+	runWaitBenchmark(b, func(b *testing.B, n int, persist bool) {
+		q := newTestQueue(n)
+		waitStore.flush()
+		down := make([]trapConverted, n)
+		up := make([]trapConverted, n)
+		for i := 0; i < n; i++ {
+			down[i] = testWaitTrap(i, testLinkDown, "linkDown")
+			up[i] = testWaitTrap(i, testLinkUp, "linkUp")
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			q.correlate(up[i%n])
+			q.correlate(down[i%n])
+			flushWaitStore(i, persist)
+		}
+		waitStore.flush()
+	})
+}
+
+// Выборка одного истёкшего трапа и возврат его в очередь, размер очереди не меняется
+func BenchmarkWaitQueuePull(b *testing.B) {
+	setupWaitTest(b)
+
+	runWaitBenchmark(b, func(b *testing.B, n int, persist bool) {
+		const step = time.Millisecond
+		now := time.Now()
+
+		q := &queueToWait{m: make(map[string]*waitItem, n)}
+		q.Lock()
+		for i := 0; i < n; i++ {
+			trap := testWaitTrap(i, testLinkDown, "linkDown")
+			trap.time = now.Add(time.Duration(i)*step + step/2)
+			q.insert(trap.waitKey(), trap)
+		}
+		q.Unlock()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			now = now.Add(step)
+			for _, trap := range q.pull(now) {
+				trap.time = now.Add(time.Duration(n) * step)
+				q.Lock()
+				q.insert(trap.waitKey(), trap)
+				waitStore.set(trap) // Как checkAndPush
+				q.Unlock()
+			}
+			flushWaitStore(i, persist)
+		}
+		waitStore.flush()
+	})
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	mibs mibsType
+
+	// Корневые OID, если модули SNMPv2-SMI/RFC1155-SMI отсутствуют в каталоге
+	mibRoots = map[string]string{
+		"ccitt":           ".0",
+		"zeroDotZero":     ".0.0",
+		"iso":             ".1",
+		"org":             ".1.3",
+		"dod":             ".1.3.6",
+		"internet":        ".1.3.6.1",
+		"directory":       ".1.3.6.1.1",
+		"mgmt":            ".1.3.6.1.2",
+		"mib-2":           ".1.3.6.1.2.1",
+		"transmission":    ".1.3.6.1.2.1.10",
+		"experimental":    ".1.3.6.1.3",
+		"private":         ".1.3.6.1.4",
+		"enterprises":     ".1.3.6.1.4.1",
+		"security":        ".1.3.6.1.5",
+		"snmpV2":          ".1.3.6.1.6",
+		"snmpDomains":     ".1.3.6.1.6.1",
+		"snmpProxys":      ".1.3.6.1.6.2",
+		"snmpModules":     ".1.3.6.1.6.3",
+		"joint-iso-ccitt": ".2",
+	}
+
+	// Макросы SMI, определяющие OID
+	mibMacros = map[string]bool{
+		"MODULE-IDENTITY":    true,
+		"OBJECT-IDENTITY":    true,
+		"OBJECT-TYPE":        true,
+		"NOTIFICATION-TYPE":  true,
+		"TRAP-TYPE":          true,
+		"OBJECT-GROUP":       true,
+		"NOTIFICATION-GROUP": true,
+		"MODULE-COMPLIANCE":  true,
+		"AGENT-CAPABILITIES": true,
+	}
+)
+
+// Объект MIB с OID
+type mibNode struct {
+	module string
+	name   string
+	kind   string         // OBJECT-TYPE, NOTIFICATION-TYPE, ...
+	syntax string         // Базовый тип или TEXTUAL-CONVENTION
+	hint   string         // DISPLAY-HINT
+	enums  map[int]string // Именованные значения INTEGER
+}
+
+// Тип или TEXTUAL-CONVENTION
+type mibTypeDef struct {
+	syntax string
+	hint   string
+	enums  map[int]string
+}
+
+// Определение OID до разрешения имён: { parent 1 2 }
+type mibDef struct {
+	node   *mibNode
+	parent string
+	subids []string
+}
+
+type mibModule struct {
+	name    string
+	imports map[string]string // Имя: модуль
+	defs    []mibDef
+	types   map[string]mibTypeDef
+}
+
+type mibsType struct {
+	oid        map[string]*mibNode
+	types      map[string]mibTypeDef
+	lastChange time.Time
+	files      int
+
+	sync.RWMutex
+}
+
+func init() {
+	mibs.oid = make(map[string]*mibNode)
+	mibs.types = make(map[string]mibTypeDef)
+}
+
+// Загрузка модулей MIB из каталога при изменении файлов
+func (m *mibsType) load() {
+	entries, err := os.ReadDir(dirMibs)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't Read dir %s\n", dirMibs)
+		}
+		return
+	}
+
+	var lastChange time.Time
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(lastChange) {
+			lastChange = fi.ModTime()
+		}
+		files = append(files, filepath.Join(dirMibs, e.Name()))
+	}
+
+	if lastChange == m.lastChange && len(files) == m.files { // Файлы не изменились
+		return
+	}
+	m.lastChange = lastChange
+	m.files = len(files)
+
+	modules := make([]*mibModule, 0, len(files))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			log.Printf("Can't Read file %s\n", f)
+			continue
+		}
+		modules = append(modules, parseMib(mibTokens(b))...)
+	}
+
+	oids, types := resolveMibs(modules)
+
+	m.Lock()
+	m.oid = oids
+	m.types = types
+	m.Unlock()
+
+	log.Printf("MIB: loaded %d modules, %d objects from %s\n", len(modules), len(oids), dirMibs)
+}
+
+// Разбор текста MIB на лексемы. Комментарии "--" отбрасываются
+func mibTokens(b []byte) []string {
+	var tokens []string
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '-' && i+1 < len(b) && b[i+1] == '-': // Комментарий до конца строки или до следующего "--"
+			i += 2
+			for i < len(b) && b[i] != '\n' {
+				if b[i] == '-' && i+1 < len(b) && b[i+1] == '-' {
+					i += 2
+					break
+				}
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(b) && b[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, string(b[i:min(j+1, len(b))]))
+			i = j + 1
+		case c == '\'': // '0A'H, '0101'B
+			j := i + 1
+			for j < len(b) && b[j] != '\'' {
+				j++
+			}
+			j += 2
+			tokens = append(tokens, string(b[i:min(j, len(b))]))
+			i = j
+		case c == ':' && i+2 < len(b) && b[i+1] == ':' && b[i+2] == '=':
+			tokens = append(tokens, "::=")
+			i += 3
+		case c == '.' && i+1 < len(b) && b[i+1] == '.':
+			tokens = append(tokens, "..")
+			i += 2
+		case strings.IndexByte("{}()[],;|", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(b) && (b[j] == '_' || b[j] == '-' || b[j] >= '0' && b[j] <= '9' || b[j] >= 'a' && b[j] <= 'z' || b[j] >= 'A' && b[j] <= 'Z') {
+				if b[j] == '-' && j+1 < len(b) && b[j+1] == '-' {
+					break
+				}
+				j++
+			}
+			if j == i {
+				j++ // Неизвестный символ
+			} else {
+				tokens = append(tokens, string(b[i:j]))
+			}
+			i = j
+		}
+	}
+
+	return tokens
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Разбор модулей из лексем
+func parseMib(t []string) (result []*mibModule) {
+	var mod *mibModule
+
+	tok := func(i int) string {
+		if i < len(t) {
+			return t[i]
+		}
+		return ""
+	}
+
+	for i := 0; i < len(t); {
+		switch {
+		case tok(i+1) == "DEFINITIONS":
+			mod = &mibModule{name: t[i], imports: make(map[string]string), types: make(map[string]mibTypeDef)}
+			result = append(result, mod)
+			for i < len(t) && t[i] != "BEGIN" {
+				i++
+			}
+			i++
+
+		case mod == nil:
+			i++
+
+		case t[i] == "IMPORTS":
+			var names []string
+			for i++; i < len(t) && t[i] != ";"; i++ {
+				switch {
+				case t[i] == "FROM":
+					for _, n := range names {
+						mod.imports[n] = tok(i + 1)
+					}
+					names = names[:0]
+					i++
+				case t[i] != ",":
+					names = append(names, t[i])
+				}
+			}
+			i++
+
+		case tok(i+1) == "MACRO":
+			for i < len(t) && t[i] != "END" {
+				i++
+			}
+			i++
+
+		case t[i] == "END":
+			mod = nil
+			i++
+
+		case tok(i+1) == "OBJECT" && tok(i+2) == "IDENTIFIER" && tok(i+3) == "::=":
+			node := &mibNode{module: mod.name, name: t[i], kind: "OBJECT IDENTIFIER"}
+			var def mibDef
+			def, i = parseOidValue(t, i+4)
+			def.node = node
+			mod.defs = append(mod.defs, def)
+
+		case mibMacros[tok(i+1)]:
+			node := &mibNode{module: mod.name, name: t[i], kind: t[i+1]}
+			enterprise := ""
+			for i += 2; i < len(t) && t[i] != "::="; {
+				switch t[i] {
+				case "SYNTAX":
+					node.syntax, node.enums, i = parseSyntax(t, i+1)
+				case "DISPLAY-HINT":
+					node.hint = strings.Trim(tok(i+1), `"`)
+					i += 2
+				case "ENTERPRISE":
+					enterprise = tok(i + 1)
+					i += 2
+				default:
+					i++
+				}
+			}
+			if node.kind == "TRAP-TYPE" { // SMIv1: ::= номер, OID трапа enterprise.0.номер
+				mod.defs = append(mod.defs, mibDef{node: node, parent: enterprise, subids: []string{"0", tok(i + 1)}})
+				i += 2
+				continue
+			}
+			var def mibDef
+			def, i = parseOidValue(t, i+1)
+			def.node = node
+			mod.defs = append(mod.defs, def)
+
+		case tok(i+1) == "::=": // Тип или TEXTUAL-CONVENTION
+			name := t[i]
+			var td mibTypeDef
+			i += 2
+			if tok(i) == "TEXTUAL-CONVENTION" {
+				for i++; i < len(t) && t[i] != "SYNTAX"; i++ {
+					if t[i] == "DISPLAY-HINT" {
+						td.hint = strings.Trim(tok(i+1), `"`)
+					}
+				}
+				i++
+			} else {
+				if tok(i) == "[" { // [APPLICATION 1]
+					for i < len(t) && t[i] != "]" {
+						i++
+					}
+					i++
+				}
+				if tok(i) == "IMPLICIT" || tok(i) == "EXPLICIT" {
+					i++
+				}
+			}
+			td.syntax, td.enums, i = parseSyntax(t, i)
+			mod.types[name] = td
+
+		default:
+			i++
+		}
+	}
+
+	return
+}
+
+// SYNTAX: имя типа, именованные значения INTEGER/BITS, пропуск ограничений (SIZE ...)
+func parseSyntax(t []string, i int) (syntax string, enums map[int]string, next int) {
+	if i >= len(t) {
+		return "", nil, i
+	}
+
+	switch t[i] {
+	case "OCTET", "OBJECT":
+		syntax = t[i] + " " + t[min(i+1, len(t)-1)]
+		i += 2
+	case "SEQUENCE", "SET":
+		syntax = t[i]
+		i++
+		if i < len(t) && t[i] == "OF" {
+			return syntax, nil, i + 2
+		}
+	default:
+		syntax = t[i]
+		i++
+	}
+
+	if i < len(t) && t[i] == "{" {
+		if syntax == "SEQUENCE" || syntax == "SET" || syntax == "CHOICE" {
+			i = skipBlock(t, i, "{", "}")
+		} else {
+			enums = make(map[int]string)
+			for i++; i < len(t) && t[i] != "}"; i++ {
+				if i+3 < len(t) && t[i+1] == "(" && t[i+3] == ")" {
+					if n, err := strconv.Atoi(t[i+2]); err == nil {
+						enums[n] = t[i]
+					}
+					i += 3
+				}
+			}
+			i++
+		}
+	}
+
+	if i < len(t) && t[i] == "(" {
+		i = skipBlock(t, i, "(", ")")
+	}
+
+	return syntax, enums, i
+}
+
+func skipBlock(t []string, i int, open, close string) int {
+	depth := 0
+	for ; i < len(t); i++ {
+		switch t[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// { parent 1 2 } или { iso org(3) dod(6) 1 }
+func parseOidValue(t []string, i int) (def mibDef, next int) {
+	if i >= len(t) || t[i] != "{" {
+		return def, i
+	}
+
+	for i++; i < len(t) && t[i] != "}"; i++ {
+		s := t[i]
+		if i+3 < len(t) && t[i+1] == "(" && t[i+3] == ")" { // name(number)
+			s = t[i+2]
+			if def.parent == "" && len(def.subids) == 0 {
+				if _, err := strconv.Atoi(s); err == nil && mibRoots[t[i]] != "" {
+					s = t[i] // Корень задан именем
+				}
+			}
+			i += 3
+		}
+		if _, err := strconv.Atoi(s); err != nil && def.parent == "" && len(def.subids) == 0 {
+			def.parent = s
+			continue
+		}
+		def.subids = append(def.subids, s)
+	}
+
+	return def, i + 1
+}
+
+// Разрешение имён в OID с учётом IMPORTS
+func resolveMibs(modules []*mibModule) (map[string]*mibNode, map[string]mibTypeDef) {
+	oids := make(map[string]*mibNode)
+	types := make(map[string]mibTypeDef)
+	byName := make(map[string]string) // module::name: OID
+	global := make(map[string]string) // name: OID
+
+	for _, mod := range modules {
+		for n, td := range mod.types {
+			types[n] = td
+		}
+	}
+
+	resolve := func(mod *mibModule, name string) (string, bool) {
+		if from, have := mod.imports[name]; have {
+			if oid, have := byName[from+"::"+name]; have {
+				return oid, true
+			}
+		}
+		if oid, have := byName[mod.name+"::"+name]; have {
+			return oid, true
+		}
+		if oid, have := global[name]; have {
+			return oid, true
+		}
+		oid, have := mibRoots[name]
+		return oid, have
+	}
+
+	pending := make(map[*mibModule][]mibDef)
+	for _, mod := range modules {
+		pending[mod] = mod.defs
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for mod, defs := range pending {
+			rest := defs[:0]
+			for _, d := range defs {
+				oid := ""
+				if d.parent != "" {
+					p, have := resolve(mod, d.parent)
+					if !have {
+						rest = append(rest, d)
+						continue
+					}
+					oid = p
+				}
+				for _, s := range d.subids {
+					oid += "." + s
+				}
+				if oid == "" {
+					continue
+				}
+				byName[mod.name+"::"+d.node.name] = oid
+				global[d.node.name] = oid
+				if _, have := oids[oid]; !have || d.node.kind != "OBJECT IDENTIFIER" {
+					oids[oid] = d.node
+				}
+				progress = true
+			}
+			pending[mod] = rest
+		}
+	}
+
+	// Именованные значения и DISPLAY-HINT из типов и TEXTUAL-CONVENTION
+	for _, node := range oids {
+		syntax := node.syntax
+		for depth := 0; depth < 8; depth++ {
+			td, have := types[syntax]
+			if !have {
+				break
+			}
+			if node.enums == nil && len(td.enums) > 0 {
+				node.enums = td.enums
+			}
+			if node.hint == "" {
+				node.hint = td.hint
+			}
+			syntax = td.syntax
+		}
+		if len(node.enums) == 0 {
+			node.enums = nil
+		}
+	}
+
+	for mod, defs := range pending {
+		for _, d := range defs {
+			if debug {
+				log.Printf("MIB: %s::%s unresolved parent %s\n", mod.name, d.node.name, d.parent)
+			}
+		}
+	}
+
+	return oids, types
+}
+
+// Объект MIB по OID переменной: ближайший по префиксу OBJECT-TYPE и индекс экземпляра
+func (m *mibsType) object(oid string) (*mibNode, string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for i := len(oid); i > 0; i = strings.LastIndexByte(oid[:i], '.') {
+		if node, have := m.oid[oid[:i]]; have {
+			if node.kind != "OBJECT-TYPE" && i != len(oid) {
+				return nil, ""
+			}
+			return node, strings.TrimPrefix(oid[i:], ".")
+		}
+	}
+
+	return nil, ""
+}
+
+// Объект с таким именем есть в загруженных MIB
+func (m *mibsType) has(name string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, node := range m.oid {
+		if node.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Имя трапа (NOTIFICATION-TYPE, TRAP-TYPE) по OID
+func (m *mibsType) notification(oid string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	if node, have := m.oid[oid]; have {
+		return node.name
+	}
+	return ""
+}
+
+// Метка значения INTEGER по MIB
+func (m *mibsType) enum(oid, value string) string {
+	node, _ := m.object(oid)
+	if node == nil || node.enums == nil {
+		return value
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return value
+	}
+	if label, have := node.enums[n]; have {
+		return label
+	}
+
+	return value
+}
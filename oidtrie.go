@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+)
+
+// Префиксное дерево OID по компонентам. Поиск самого длинного совпадающего префикса
+type oidTrie struct {
+	child  map[string]*oidTrie
+	prefix string // OID, добавленный в дерево, оканчивается на этом узле
+	have   bool
+}
+
+func newOidTrie() *oidTrie {
+	return &oidTrie{child: make(map[string]*oidTrie)}
+}
+
+func (t *oidTrie) insert(oid string) {
+	n := t
+	for _, c := range strings.Split(strings.Trim(oid, "."), ".") {
+		next, have := n.child[c]
+		if !have {
+			next = newOidTrie()
+			n.child[c] = next
+		}
+		n = next
+	}
+	n.prefix = oid
+	n.have = true
+}
+
+// Самый длинный префикс из дерева и оставшаяся часть OID (индекс экземпляра) без ведущей "."
+func (t *oidTrie) lookup(oid string) (prefix, suffix string, have bool) {
+	s := strings.TrimPrefix(oid, ".")
+	n := t
+	for pos := 0; pos <= len(s); {
+		end := strings.IndexByte(s[pos:], '.')
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += pos
+		}
+		next, ok := n.child[s[pos:end]]
+		if !ok {
+			break
+		}
+		n = next
+		if n.have {
+			prefix, have = n.prefix, true
+			suffix = ""
+			if end < len(s) {
+				suffix = s[end+1:]
+			}
+		}
+		pos = end + 1
+	}
+
+	return
+}
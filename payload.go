@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+// Форматы значения элемента данных
+const (
+	payloadFlat      = "flat"      // {"имя": "значение", "lastdigit": "3"}
+	payloadRich      = "rich"      // JSON с oid, типом и значением всех переменных
+	payloadSnmptrapd = "snmptrapd" // Строка в формате snmptrapd
+	payloadTemplate  = "template"  // Произвольный текст по шаблону
+)
+
+var (
+	payloadDefault payloadDefaultType
+
+	// Типы значений в выводе snmptrapd
+	snmptrapdTypes = map[snmp.Asn1BER]string{
+		snmp.Integer:          "INTEGER",
+		snmp.OctetString:      "STRING",
+		snmp.ObjectIdentifier: "OID",
+		snmp.IPAddress:        "IpAddress",
+		snmp.Counter32:        "Counter32",
+		snmp.Gauge32:          "Gauge32",
+		snmp.TimeTicks:        "Timeticks",
+		snmp.Opaque:           "Opaque",
+		snmp.Counter64:        "Counter64",
+		snmp.Uinteger32:       "UInteger32",
+		snmp.OpaqueFloat:      "Opaque: Float",
+		snmp.OpaqueDouble:     "Opaque: Double",
+		snmp.Null:             "NULL",
+	}
+)
+
+// Формат значения в cred.json
+type configPayload struct {
+	Format string `json:"format"` // flat, rich, snmptrapd, template
+	Text   string `json:"text"`   // Шаблон для template
+}
+
+// Формат значения трапа. Пустой format - формат по умолчанию из cred.json
+type payloadType struct {
+	format string
+	text   *keyTemplate
+}
+
+type payloadDefaultType struct {
+	payloadType
+
+	sync.RWMutex
+}
+
+// Переменная трапа в формате rich
+type richVar struct {
+	Oid   string `json:"oid"`
+	Name  string `json:"name,omitempty"`
+	Index string `json:"index,omitempty"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Значение трапа в формате rich
+type richPayload struct {
+	Trap      string    `json:"trap"`
+	Oid       string    `json:"oid"`
+	Source    string    `json:"source"`
+	Host      string    `json:"host"`
+	LastDigit string    `json:"lastdigit"`
+	IfIndex   string    `json:"ifindex,omitempty"`
+	Index     []string  `json:"index,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	Vars      []richVar `json:"vars"`
+}
+
+func parsePayload(format, text string) (p payloadType, err error) {
+	switch format {
+	case payloadFlat, payloadRich, payloadSnmptrapd:
+		p.format = format
+	case payloadTemplate:
+		p.format = format
+		if text == "" {
+			return p, fmt.Errorf("empty template")
+		}
+	case "":
+		if text != "" { // Задан только шаблон
+			p.format = payloadTemplate
+		}
+	default:
+		return p, fmt.Errorf("unknown payload format %s", format)
+	}
+
+	if p.format == payloadTemplate {
+		p.text, err = parseTextTemplate(text)
+	}
+
+	return
+}
+
+// Проверка формата трапа после разбора параметров payload и text из traps.txt
+func (p *payloadType) check() error {
+	switch p.format {
+	case payloadFlat, payloadRich, payloadSnmptrapd:
+	case "", payloadTemplate:
+		if p.text != nil {
+			p.format = payloadTemplate
+		} else if p.format == payloadTemplate {
+			p.format = ""
+			return fmt.Errorf("empty template")
+		}
+	default:
+		format := p.format
+		*p = payloadType{}
+		return fmt.Errorf("unknown payload format %s", format)
+	}
+	return nil
+}
+
+func (p *payloadDefaultType) load(cfg configPayload) {
+	payload, err := parsePayload(cfg.Format, cfg.Text)
+	if err != nil {
+		log.Printf("ERROR: payload: %+v\n", err)
+		return
+	}
+
+	p.Lock()
+	p.payloadType = payload
+	p.Unlock()
+
+	p.checkText()
+}
+
+// Шаблон с неизвестной подстановкой применяется, как и в traps.txt
+func (p *payloadDefaultType) checkText() {
+	if text := p.get().text; text != nil {
+		if err := text.check(); err != nil {
+			log.Printf("WARNING: payload text: %+v\n", err)
+		}
+	}
+}
+
+func (p *payloadDefaultType) get() payloadType {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.payloadType
+}
+
+// Значение элемента данных для хоста в формате трапа или по умолчанию
+func makeValues(trap trapToSend, hostname string) string {
+	payload := trap.payload
+	if payload.format == "" {
+		payload = payloadDefault.get()
+	}
+
+	switch payload.format {
+	case payloadRich:
+		return makeRichValues(trap, hostname)
+	case payloadSnmptrapd:
+		return makeSnmptrapdValues(trap)
+	case payloadTemplate:
+		return payload.text.render(trap, hostname)
+	}
+
+	return makeFlatValues(trap)
+}
+
+func makeFlatValues(trap trapToSend) string {
+	var kv map[string]string = make(map[string]string)
+
+	kv["lastdigit"] = trap.lastDigit
+	if trap.count > 0 {
+		kv["count"] = strconv.Itoa(trap.count)
+	}
+	for _, i := range trap.packet {
+		if i.name == "" || i.name == "ifIndex" { // Только именованные переменные, ifIndex передаётся в ключе
+			continue
+		}
+		kv[i.name] = i.value
+	}
+
+	b, err := json.Marshal(kv)
+	if err != nil {
+		log.Printf("JSON Error: %+v\nTried encoding: %+v\n", err, kv)
+		return ""
+	}
+
+	return string(b)
+}
+
+func makeRichValues(trap trapToSend, hostname string) string {
+	r := richPayload{
+		Trap:      trap.name,
+		Oid:       trap.oid,
+		Source:    trap.addr.IP.String(),
+		Host:      hostname,
+		LastDigit: trap.lastDigit,
+		IfIndex:   trap.ifIndex,
+		Index:     trap.index,
+		Count:     trap.count,
+		Vars:      make([]richVar, 0, len(trap.packet)),
+	}
+	for _, i := range trap.packet {
+		r.Vars = append(r.Vars, richVar{Oid: i.oid, Name: i.name, Index: i.index, Type: snmptrapdType(i.asn1BER), Value: i.value})
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("JSON Error: %+v\nTried encoding: %+v\n", err, r)
+		return ""
+	}
+
+	return string(b)
+}
+
+// 2023-10-18 13:30:15 10.0.0.1 [UDP: [10.0.0.1]:161]: SNMPv2-MIB::snmpTrapOID.0 = OID: linkDown	ifIndex.5 = INTEGER: 5
+func makeSnmptrapdValues(trap trapToSend) string {
+	var b strings.Builder
+
+	transport := trap.transport
+	if transport == "" { // Трапы, созданные без приёма: шторм, проверка сценария /scripts/test
+		transport = transportUDP
+	}
+	if trap.addr.IP != nil && trap.addr.IP.To4() == nil { // Как в net-snmp: UDP/IPv6, TCP/IPv6
+		transport += "/IPv6"
+	}
+
+	ip := trap.addr.IP.String()
+	b.WriteString(trap.time.Format("2006-01-02 15:04:05") + " " + ip + " [" + transport + ": [" + ip + "]:" + strconv.Itoa(trap.addr.Port) + "]: ")
+
+	oid := trap.oid
+	if trap.name != "" {
+		oid = trap.name
+	}
+	b.WriteString("SNMPv2-MIB::snmpTrapOID.0 = OID: " + oid)
+	if vars := snmptrapdVars(trap.packet); vars != "" {
+		b.WriteString("\t" + vars)
+	}
+
+	return b.String()
+}
+
+// Переменные трапа через табуляцию: имя.индекс = ТИП: значение
+func snmptrapdVars(packet []snmpPacket) string {
+	result := make([]string, 0, len(packet))
+
+	for _, i := range packet {
+		name := i.oid
+		if i.name != "" {
+			name = i.name
+			if i.index != "" {
+				name += "." + i.index
+			}
+		}
+		value := i.value
+		if i.asn1BER == snmp.OctetString { // Кавычки и \ внутри строки экранируются, как в snmptrapd
+			value = `"` + snmptrapdEscape.Replace(value) + `"`
+		}
+		result = append(result, name+" = "+snmptrapdType(i.asn1BER)+": "+value)
+	}
+
+	return strings.Join(result, "\t")
+}
+
+var snmptrapdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func snmptrapdType(t snmp.Asn1BER) string {
+	if s, have := snmptrapdTypes[t]; have {
+		return s
+	}
+	return fmt.Sprintf("0x%x", byte(t))
+}
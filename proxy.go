@@ -18,8 +18,9 @@ type proxiesType struct {
 }
 
 type proxyType struct {
-	addr net.TCPAddr
-	ch   chan trapToSend
+	addr     net.TCPAddr
+	instance string // instance Zabbix, в котором прокси впервые найден: параметры TLS
+	ch       chan trapToSend
 }
 
 func init() {
@@ -39,12 +40,27 @@ func toSender(trap trapConverted) {
 
 	var trapForSend trapToSend
 
-	for _, i := range hosts.idsByIP(trap.addr) {
+	ids := hosts.idsByIP(trap.addr)
+	if trap.host != "" { // Хост назначен сценарием
+		ids = hosts.idsByName(trap.host)
+	}
+
+	for _, i := range ids {
+		if replay.confirmedBy(hosts.proxyName(i), trap.time) { // Повторённый трап уже доставлен прежним master
+			continue
+		}
 		trapForSend.time = trap.time
 		trapForSend.addr = trap.addr
+		trapForSend.transport = trap.transport
 		trapForSend.name = trap.name
 		trapForSend.lastDigit = trap.lastDigit
 		trapForSend.ifIndex = trap.ifIndex
+		trapForSend.index = trap.index
+		trapForSend.host = trap.host
+		trapForSend.count = trap.count
+		trapForSend.oid = trap.oid
+		trapForSend.key = trap.key
+		trapForSend.payload = trap.payload
 		trapForSend.packet = trap.packet
 		trapForSend.proxy = hosts.proxyName(i)
 		proxies.chSend(hosts.proxyName(i), trapForSend)
@@ -61,7 +77,7 @@ func (p *proxiesType) chSend(proxyName string, trapForSend trapToSend) {
 	p.p[proxyName].ch <- trapForSend
 }
 
-func (p *proxiesType) add(proxyName string) {
+func (p *proxiesType) add(proxyName string, instance string) {
 	if proxyName == "" {
 		return // пока не знаю что с этим делать
 	}
@@ -110,13 +126,14 @@ func (p *proxiesType) add(proxyName string) {
 		}
 	}
 	proxy.addr.IP = net.ParseIP(s[0])
+	proxy.instance = instance
 	proxy.ch = make(chan trapToSend, chBuffer)
 
 	p.Lock()
 	p.p[proxyName] = proxy
 	p.Unlock()
 
-	go trapSender(proxy.ch)
+	go trapSender(proxyName, proxy.ch)
 }
 
 func (p *proxiesType) addr(name string) net.TCPAddr {
@@ -126,6 +143,13 @@ func (p *proxiesType) addr(name string) net.TCPAddr {
 	return proxies.p[name].addr
 }
 
+func (p *proxiesType) instance(name string) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.p[name].instance
+}
+
 func (p *proxiesType) deleteUnused() {
 	var index []string = make([]string, 0) // Список прокси на удаление
 
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	snmp "github.com/gosnmp/gosnmp"
+	"golang.org/x/text/encoding"
+)
+
+// Подсказки формата значения в vars.txt
+const (
+	hintHex      = "hex"      // 0A 1B 2C
+	hintMac      = "mac"      // 00:1b:2c:3d:4e:5f
+	hintASCII    = "ascii"    // Непечатаемые символы заменяются на "."
+	hintUTF8     = "utf8"     // Некорректные последовательности заменяются на "?"
+	hintDateTime = "datetime" // DateAndTime (SNMPv2-TC) в RFC3339
+	hintOid      = "oid"      // OID в символьное имя по MIB
+	hintDuration = "duration" // TimeTicks в длительность
+)
+
+var (
+	renderHints = map[string]bool{
+		hintHex:      true,
+		hintMac:      true,
+		hintASCII:    true,
+		hintUTF8:     true,
+		hintDateTime: true,
+		hintOid:      true,
+		hintDuration: true,
+	}
+)
+
+// Значение переменной по типу ASN.1, подсказке из vars.txt или типу из MIB. Строки перекодируются в UTF-8 из enc
+func renderValue(p snmpPacket, hint string, enc encoding.Encoding) string {
+	if hint == "" {
+		hint = mibHint(p)
+	}
+
+	switch hint {
+	case hintHex:
+		return hexString(p.value, " ")
+	case hintMac:
+		return strings.ToLower(hexString(p.value, ":"))
+	case hintASCII:
+		return asciiString(p.value)
+	case hintUTF8:
+		return strings.ToValidUTF8(p.value, "?")
+	case hintDateTime:
+		if t, err := dateAndTime([]byte(p.value)); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+		return hexString(p.value, " ")
+	case hintOid:
+		if node, index := mibs.object(p.value); node != nil {
+			if index != "" {
+				return node.name + "." + index
+			}
+			return node.name
+		}
+		return p.value
+	case hintDuration:
+		if ticks, err := strconv.ParseUint(p.value, 10, 64); err == nil {
+			return (time.Duration(ticks) * 10 * time.Millisecond).String()
+		}
+		return p.value
+	}
+
+	switch p.asn1BER {
+	case snmp.OctetString:
+		if s := charsets.decode(strings.TrimRight(p.value, "\x00"), enc); printable(s) {
+			return s
+		}
+		return hexString(p.value, " ")
+	case snmp.Integer:
+		return mibs.enum(p.oid, p.value)
+	}
+
+	return p.value
+}
+
+// Формат по типу OBJECT-TYPE или TEXTUAL-CONVENTION из MIB
+func mibHint(p snmpPacket) string {
+	if p.asn1BER != snmp.OctetString {
+		return ""
+	}
+
+	node, _ := mibs.object(p.oid)
+	if node == nil {
+		return ""
+	}
+
+	switch {
+	case node.syntax == "DateAndTime":
+		return hintDateTime
+	case node.syntax == "MacAddress" || node.syntax == "PhysAddress" || node.hint == "1x:":
+		return hintMac
+	}
+
+	return ""
+}
+
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\r' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+func hexString(s, sep string) string {
+	result := make([]string, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		result = append(result, fmt.Sprintf("%02X", s[i]))
+	}
+	return strings.Join(result, sep)
+}
+
+func asciiString(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			b[i] = '.'
+		}
+	}
+	return string(b)
+}
+
+// DateAndTime (SNMPv2-TC): год(2) месяц день час минута секунда децисекунда [направление часы минуты от UTC]
+func dateAndTime(b []byte) (time.Time, error) {
+	if len(b) != 8 && len(b) != 11 {
+		return time.Time{}, fmt.Errorf("wrong DateAndTime length %d", len(b))
+	}
+
+	loc := time.UTC
+	if len(b) == 11 {
+		offset := int(b[9])*3600 + int(b[10])*60
+		if b[8] == '-' {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+
+	return time.Date(int(b[0])<<8|int(b[1]), time.Month(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6]), int(b[7])*100000000, loc), nil
+}
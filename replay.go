@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	replayWindow      = 30 * time.Second // Сколько хранить трапы на резервном узле
+	replayMax         = chBuffer * 8     // Ограничение размера буфера
+	replayClockMargin = time.Second      // Запас на точность оценки разницы часов узлов: лучше повтор, чем потеря
+)
+
+var (
+	replay replayType
+)
+
+// Буфер трапов резервного узла кластера для повторной обработки при переключении на master.
+// Доставка отмечается по каждому прокси: отправка на прокси идёт по порядку, поэтому все его трапы
+// не позже отметки доставлены. Пока прокси недоступен и трапы в буфере spool, его отметка не растёт
+type replayType struct {
+	t         []trapRaw
+	delivered map[string]time.Time // Прокси: время последнего доставленного трапа (на master)
+	confirmed map[string]time.Time // Прокси: отметки прежнего master по нашим часам, для повторённых трапов
+	until     time.Time            // До какого времени действуют confirmed
+
+	sync.RWMutex
+}
+
+func init() {
+	replay.delivered = make(map[string]time.Time)
+}
+
+// Трап, который обработал бы master
+func (r *replayType) push(trap trapRaw) {
+	r.Lock()
+	defer r.Unlock()
+
+	border := time.Now().Add(-replayWindow)
+	i := 0
+	for i < len(r.t) && r.t[i].time.Before(border) {
+		i++
+	}
+	if len(r.t)-i >= replayMax {
+		i = len(r.t) - replayMax + 1
+	}
+	if i > 0 {
+		r.t = append(r.t[:0], r.t[i:]...)
+	}
+
+	r.t = append(r.t, trap)
+}
+
+// Отметка о доставке на прокси трапов с временем до t включительно
+func (r *replayType) setDelivered(proxyName string, t time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if t.After(r.delivered[proxyName]) {
+		r.delivered[proxyName] = t
+	}
+}
+
+func (r *replayType) watermark() map[string]time.Time {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.delivered) == 0 {
+		return nil
+	}
+
+	result := make(map[string]time.Time, len(r.delivered))
+	for proxy, t := range r.delivered {
+		result[proxy] = t
+	}
+	return result
+}
+
+// Трап уже доставлен на прокси прежним master. Проверяется перед отправкой на прокси,
+// новые трапы позже отметок, поэтому отбрасываются только повторённые
+func (r *replayType) confirmedBy(proxyName string, t time.Time) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.confirmed == nil || time.Now().After(r.until) {
+		return false
+	}
+	w, have := r.confirmed[proxyName]
+	return have && !t.After(w)
+}
+
+// Повторная обработка трапов при переключении в master. Отметки доставки прежнего master уже переведены
+// на наши часы. Буфер повторяется целиком: прокси трапа известен только после обработки,
+// а доставленные трапы отбрасываются перед отправкой по отметке их прокси
+func (r *replayType) start(watermarks map[string]time.Time) {
+	r.Lock()
+	border := time.Now().Add(-replayWindow)
+	result := make([]trapRaw, 0, len(r.t))
+	for _, i := range r.t {
+		if i.time.After(border) {
+			result = append(result, i)
+		}
+	}
+	r.t = nil
+	r.confirmed = watermarks
+	r.until = time.Now().Add(replayWindow)
+	for proxy, t := range watermarks {
+		if t.After(r.delivered[proxy]) {
+			r.delivered[proxy] = t
+		}
+	}
+	r.Unlock()
+
+	if len(result) == 0 {
+		return
+	}
+
+	log.Printf("Cluster: replay %d traps, delivery confirmed for %d proxies\n", len(result), len(watermarks))
+
+	go func() {
+		for _, i := range result {
+			chTrapRaw <- i
+			stats.newReplayedTrap()
+		}
+	}()
+}
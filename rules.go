@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+// Действия правил преобразования переменных
+const (
+	ruleReplace  = "replace"  // Замена по регулярному выражению
+	ruleMap      = "map"      // Таблица соответствия значений
+	ruleMath     = "math"     // value * mul / div + add для числовых значений
+	ruleTruncate = "truncate" // Ограничение длины в символах
+	ruleRename   = "rename"
+	ruleDrop     = "drop"
+	ruleSet      = "set" // Вычисляемое поле по шаблону: "{ifDescr} ({ifAlias})"
+)
+
+var (
+	rules rulesType
+)
+
+// Правило в rules.json. Условия match объединяются по И, пустое условие подходит для всех трапов
+type configRule struct {
+	Name    string         `json:"name"`
+	Match   configMatch    `json:"match"`
+	Actions []configAction `json:"actions"`
+}
+
+type configMatch struct {
+	Oid    string `json:"oid"`    // Префикс OID трапа
+	Source string `json:"source"` // IP или CIDR источника
+	Host   string `json:"host"`   // Имя хоста в Zabbix, допускается шаблон: "sw-*"
+}
+
+type configAction struct {
+	Op        string            `json:"op"`
+	Field     string            `json:"field"`
+	Regex     string            `json:"regex"`
+	With      string            `json:"with"`
+	Table     map[string]string `json:"table"`
+	Default   *string           `json:"default"` // Значение для map при отсутствии в таблице, иначе без изменений
+	Mul       *float64          `json:"mul"`
+	Div       *float64          `json:"div"`
+	Add       *float64          `json:"add"`
+	Precision *int              `json:"precision"` // Знаков после запятой для math
+	Length    int               `json:"length"`
+	To        string            `json:"to"`
+	Value     string            `json:"value"`
+}
+
+type ruleAction struct {
+	configAction
+	re   *regexp.Regexp
+	text *keyTemplate
+}
+
+type ruleType struct {
+	name    string
+	oid     string
+	source  *net.IPNet
+	host    string
+	actions []ruleAction
+}
+
+type rulesType struct {
+	r              []ruleType
+	lastFileChange time.Time
+
+	sync.RWMutex
+}
+
+// Загрузка правил преобразования. Правило с ошибкой пропускается целиком
+func (r *rulesType) load() {
+	fst, err := os.Stat(fileRules)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't Stat info of file %s\n", fileRules)
+		}
+		return
+	}
+
+	if r.lastFileChange == fst.ModTime() { // Дата модификации файла не изменилась
+		return
+	}
+	r.lastFileChange = fst.ModTime()
+
+	b, err := os.ReadFile(fileRules)
+	if err != nil {
+		log.Printf("Can't Read file %s\n", fileRules)
+		return
+	}
+
+	var cfg []configRule
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Printf("Can't Unmarshal file %s: %+v\n", fileRules, err)
+		return
+	}
+
+	result := make([]ruleType, 0, len(cfg))
+	for i, c := range cfg {
+		rule, err := c.rule()
+		if err != nil {
+			log.Printf("ERROR: rule %d %s: %+v\n", i+1, c.Name, err)
+			continue
+		}
+		result = append(result, rule)
+	}
+
+	r.Lock()
+	r.r = result
+	r.Unlock()
+
+	log.Printf("Rules: loaded %d of %d from %s\n", len(result), len(cfg), fileRules)
+}
+
+// Переменная с таким именем появляется после правил: set или rename
+func (r *rulesType) sets(name string) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, rule := range r.r {
+		for _, a := range rule.actions {
+			if a.Op == ruleSet && a.Field == name || a.Op == ruleRename && a.To == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c configRule) rule() (rule ruleType, err error) {
+	rule.name = c.Name
+	rule.host = c.Match.Host
+	rule.oid = c.Match.Oid
+	if rule.oid != "" && rule.oid[0] != '.' {
+		rule.oid = "." + rule.oid
+	}
+
+	if s := c.Match.Source; s != "" {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		if _, rule.source, err = net.ParseCIDR(s); err != nil {
+			return
+		}
+	}
+
+	if rule.host != "" {
+		if _, err = path.Match(rule.host, ""); err != nil {
+			return
+		}
+	}
+
+	for _, a := range c.Actions {
+		action := ruleAction{configAction: a}
+		if a.Field == "" {
+			return rule, fmt.Errorf("%s: empty field", a.Op)
+		}
+		switch a.Op {
+		case ruleReplace:
+			if action.re, err = regexp.Compile(a.Regex); err != nil {
+				return
+			}
+		case ruleMap:
+			if a.Table == nil {
+				return rule, fmt.Errorf("%s %s: empty table", a.Op, a.Field)
+			}
+		case ruleMath:
+			if a.Div != nil && *a.Div == 0 {
+				return rule, fmt.Errorf("%s %s: division by zero", a.Op, a.Field)
+			}
+		case ruleTruncate:
+			if a.Length <= 0 {
+				return rule, fmt.Errorf("%s %s: wrong length %d", a.Op, a.Field, a.Length)
+			}
+		case ruleRename:
+			if a.To == "" {
+				return rule, fmt.Errorf("%s %s: empty new name", a.Op, a.Field)
+			}
+		case ruleDrop:
+		case ruleSet:
+			if action.text, err = parseTextTemplate(a.Value); err != nil {
+				return
+			}
+		default:
+			return rule, fmt.Errorf("unknown action %q", a.Op)
+		}
+		rule.actions = append(rule.actions, action)
+	}
+
+	return
+}
+
+func (r ruleType) match(trap trapConverted) bool {
+	if r.oid != "" && trap.oid != r.oid && !strings.HasPrefix(trap.oid, r.oid+".") {
+		return false
+	}
+	if r.source != nil && !r.source.Contains(trap.addr.IP) {
+		return false
+	}
+	if r.host != "" {
+		for _, h := range hosts.names(trap.addr) {
+			if ok, _ := path.Match(r.host, h); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Применение подходящих правил по порядку к переменным трапа
+func (r *rulesType) apply(trap trapConverted) []snmpPacket {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, rule := range r.r {
+		if !rule.match(trap) {
+			continue
+		}
+		for _, a := range rule.actions {
+			trap.packet = a.apply(trap)
+		}
+		if debug {
+			log.Printf("Rule %s applied to %s from %s\n", rule.name, trap.name, trap.addr.IP.String())
+		}
+	}
+
+	return trap.packet
+}
+
+func (a ruleAction) apply(trap trapConverted) []snmpPacket {
+	if a.Op == ruleSet { // Вычисляемое поле заменяет существующее или добавляется
+		value := a.text.render(trapToSend{trapConverted: trap}, "")
+		for i := range trap.packet {
+			if trap.packet[i].name == a.Field {
+				trap.packet[i].value = value
+				return trap.packet
+			}
+		}
+		return append(trap.packet, snmpPacket{name: a.Field, value: value, asn1BER: snmp.OctetString})
+	}
+
+	result := make([]snmpPacket, 0, len(trap.packet))
+	for _, p := range trap.packet {
+		if p.name != a.Field {
+			result = append(result, p)
+			continue
+		}
+		switch a.Op {
+		case ruleReplace:
+			p.value = a.re.ReplaceAllString(p.value, a.With)
+		case ruleMap:
+			if v, have := a.Table[p.value]; have {
+				p.value = v
+			} else if a.Default != nil {
+				p.value = *a.Default
+			}
+		case ruleMath:
+			p.value = a.math(p.value)
+		case ruleTruncate:
+			if utf8.RuneCountInString(p.value) > a.Length {
+				p.value = string([]rune(p.value)[:a.Length])
+			}
+		case ruleRename:
+			p.name = a.To
+		case ruleDrop:
+			continue
+		}
+		result = append(result, p)
+	}
+
+	return result
+}
+
+func (a ruleAction) math(value string) string {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+
+	if a.Mul != nil {
+		v *= *a.Mul
+	}
+	if a.Div != nil {
+		v /= *a.Div
+	}
+	if a.Add != nil {
+		v += *a.Add
+	}
+
+	if a.Precision != nil {
+		return strconv.FormatFloat(v, 'f', *a.Precision, 64)
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,971 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+// Встроенный язык сценариев для трапов. Циклов нет, число шагов и время выполнения ограничены.
+//
+//	# комментарий
+//	if $hwAlarmSeverity == 1 || byte(raw($hwAlarmMask), 0) & 0x80 {
+//	    $severity = "critical"
+//	} else if contains($hwAlarmText, "test") {
+//	    drop
+//	}
+//	delete $hwAlarmSequence
+//	host = "core-" + lower($hwSiteName)
+//
+// $имя - переменная трапа (отсутствующая - пустая строка), raw($имя) - исходные байты строкового значения,
+// поля трапа: source, name, oid, ifIndex, lastdigit, host. else пишется на одной строке с "}".
+// Присваиваются переменные и поля name, lastdigit, ifIndex, host (отправка трапа на другой хост Zabbix).
+
+const (
+	scriptMaxSteps   = 100000
+	scriptMaxInt     = 1 << 53 // Целые за пределами точного представления float64 - ошибка
+	scriptMaxRegexps = 256     // Размер кэша регулярных выражений, заданных не константой
+)
+
+var (
+	errScriptTimeout = errors.New("script time limit exceeded")
+	errScriptSteps   = errors.New("script step limit exceeded")
+)
+
+// Окружение выполнения сценария
+type scriptEnv struct {
+	trap     *trapConverted
+	drop     bool
+	deadline time.Time
+	steps    int
+}
+
+func (e *scriptEnv) step() error {
+	e.steps++
+	if e.steps > scriptMaxSteps {
+		return errScriptSteps
+	}
+	if e.steps%64 == 0 {
+		return e.checkDeadline()
+	}
+	return nil
+}
+
+func (e *scriptEnv) checkDeadline() error {
+	if time.Now().After(e.deadline) {
+		return errScriptTimeout
+	}
+	return nil
+}
+
+func (e *scriptEnv) get(name string) string {
+	for _, p := range e.trap.packet {
+		if p.name == name {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// Значения: string, float64, bool
+type scriptValue interface{}
+
+type scriptExpr interface {
+	eval(e *scriptEnv) (scriptValue, error)
+}
+
+type scriptStmt interface {
+	exec(e *scriptEnv) error
+}
+
+// Лексемы
+
+type scriptToken struct {
+	kind string // ident, var, num, str, op, nl, eof
+	text string
+	line int
+}
+
+func scriptLex(src string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	line := 1
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n' || c == ';':
+			tokens = append(tokens, scriptToken{kind: "nl", line: line})
+			if c == '\n' {
+				line++
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			tokens = append(tokens, scriptToken{kind: "str", text: s, line: line})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (isIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, scriptToken{kind: "num", text: src[i:j], line: line})
+			i = j
+		case c == '$':
+			j := i + 1
+			for j < len(src) && (isIdentChar(src[j]) || src[j] == '-') {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("line %d: empty variable name", line)
+			}
+			tokens = append(tokens, scriptToken{kind: "var", text: src[i+1 : j], line: line})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			tokens = append(tokens, scriptToken{kind: "ident", text: src[i:j], line: line})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||", "<<", ">>"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("=<>+-*/%!&|^(){},", rune(c)) {
+					return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+				}
+				op = string(c)
+			}
+			tokens = append(tokens, scriptToken{kind: "op", text: op, line: line})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, scriptToken{kind: "eof", line: line}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Разбор
+
+type scriptParser struct {
+	t   []scriptToken
+	pos int
+}
+
+func parseScript(src string) ([]scriptStmt, error) {
+	tokens, err := scriptLex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &scriptParser{t: tokens}
+	stmts, err := p.block("eof")
+	if err != nil {
+		return nil, err
+	}
+
+	return stmts, nil
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.t[p.pos]
+}
+
+func (t scriptToken) String() string {
+	switch t.kind {
+	case "eof":
+		return "end of script"
+	case "nl":
+		return "end of line"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (p *scriptParser) next() scriptToken {
+	t := p.t[p.pos]
+	if p.pos < len(p.t)-1 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scriptParser) is(kind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *scriptParser) expect(kind, text string) error {
+	if t := p.next(); t.kind != kind || t.text != text {
+		return fmt.Errorf("line %d: expected %q, got %s", t.line, text, t)
+	}
+	return nil
+}
+
+func (p *scriptParser) skipNL() {
+	for p.peek().kind == "nl" {
+		p.next()
+	}
+}
+
+// Операторы до "}" или конца сценария
+func (p *scriptParser) block(end string) (result []scriptStmt, err error) {
+	for {
+		p.skipNL()
+		if t := p.peek(); t.kind == "eof" || end == "}" && p.is("op", "}") {
+			if t.kind == "eof" && end == "}" {
+				return nil, fmt.Errorf("line %d: expected \"}\"", t.line)
+			}
+			return result, nil
+		}
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+		if t := p.peek(); t.kind != "nl" && t.kind != "eof" && !p.is("op", "}") {
+			return nil, fmt.Errorf("line %d: unexpected %s", t.line, t)
+		}
+	}
+}
+
+func (p *scriptParser) braced() ([]scriptStmt, error) {
+	if err := p.expect("op", "{"); err != nil {
+		return nil, err
+	}
+	stmts, err := p.block("}")
+	if err != nil {
+		return nil, err
+	}
+	return stmts, p.expect("op", "}")
+}
+
+func (p *scriptParser) stmt() (scriptStmt, error) {
+	t := p.next()
+
+	switch {
+	case t.kind == "ident" && t.text == "if":
+		var s ifStmt
+		var err error
+		if s.cond, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if s.then, err = p.braced(); err != nil {
+			return nil, err
+		}
+		if p.is("ident", "else") {
+			p.next()
+			if p.is("ident", "if") {
+				elseIf, err := p.stmt()
+				if err != nil {
+					return nil, err
+				}
+				s.els = []scriptStmt{elseIf}
+			} else if s.els, err = p.braced(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+
+	case t.kind == "ident" && t.text == "drop":
+		return dropStmt{}, nil
+
+	case t.kind == "ident" && t.text == "delete":
+		v := p.next()
+		if v.kind != "var" {
+			return nil, fmt.Errorf("line %d: delete expects $variable", v.line)
+		}
+		return deleteStmt{name: v.text}, nil
+
+	case t.kind == "var" || t.kind == "ident" && scriptFields[t.text]:
+		if err := p.expect("op", "="); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return assignStmt{field: t.kind == "ident", name: t.text, value: value}, nil
+	}
+
+	return nil, fmt.Errorf("line %d: unexpected %s", t.line, t)
+}
+
+// Приоритет бинарных операторов
+var scriptPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"|":  4,
+	"^":  5,
+	"&":  6,
+	"<<": 7, ">>": 7,
+	"+": 8, "-": 8,
+	"*": 9, "/": 9, "%": 9,
+}
+
+func (p *scriptParser) expr() (scriptExpr, error) {
+	return p.binary(1)
+}
+
+func (p *scriptParser) binary(prec int) (scriptExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		pr, have := scriptPrec[t.text]
+		if t.kind != "op" || !have || pr < prec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(pr + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	if p.is("op", "!") || p.is("op", "-") {
+		op := p.next().text
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{op: op, x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	t := p.next()
+
+	switch t.kind {
+	case "num":
+		n, err := parseScriptNumber(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: wrong number %q", t.line, t.text)
+		}
+		return constExpr{n}, nil
+	case "str":
+		return constExpr{t.text}, nil
+	case "var":
+		return varExpr{t.text}, nil
+	case "ident":
+		switch {
+		case t.text == "true" || t.text == "false":
+			return constExpr{t.text == "true"}, nil
+		case t.text == "raw":
+			if p.expect("op", "(") != nil || p.peek().kind != "var" {
+				return nil, fmt.Errorf("line %d: raw expects $variable", t.line)
+			}
+			x := rawExpr{p.next().text}
+			return x, p.expect("op", ")")
+		case p.is("op", "("):
+			return p.call(t)
+		case scriptFields[t.text] || t.text == "source" || t.text == "oid":
+			return fieldExpr{t.text}, nil
+		}
+	case "op":
+		if t.text == "(" {
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect("op", ")")
+		}
+	}
+
+	return nil, fmt.Errorf("line %d: unexpected %s", t.line, t)
+}
+
+func (p *scriptParser) call(t scriptToken) (scriptExpr, error) {
+	f, have := scriptFuncs[t.text]
+	if !have {
+		return nil, fmt.Errorf("line %d: unknown function %s", t.line, t.text)
+	}
+
+	c := callExpr{name: t.text, f: f.f}
+	p.next() // (
+	for !p.is("op", ")") {
+		a, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, a)
+		if !p.is("op", ",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("op", ")"); err != nil {
+		return nil, err
+	}
+	if len(c.args) != f.args {
+		return nil, fmt.Errorf("line %d: %s expects %d arguments", t.line, t.text, f.args)
+	}
+
+	// Константное регулярное выражение компилируется при загрузке, ошибка в нём - ошибка сценария
+	if pattern, ok := c.args[len(c.args)-1].(constExpr); ok && c.name == "match" {
+		re, err := regexp.Compile(toString(pattern.v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", t.line, t.text, err)
+		}
+		c.f = func(a []scriptValue) (scriptValue, error) { return re.MatchString(toString(a[0])), nil }
+	}
+
+	return c, nil
+}
+
+func parseScriptNumber(s string) (float64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Операторы
+
+type ifStmt struct {
+	cond scriptExpr
+	then []scriptStmt
+	els  []scriptStmt
+}
+
+type dropStmt struct{}
+
+type deleteStmt struct {
+	name string
+}
+
+type assignStmt struct {
+	field bool // Поле трапа, иначе переменная
+	name  string
+	value scriptExpr
+}
+
+func execStmts(e *scriptEnv, stmts []scriptStmt) error {
+	for _, s := range stmts {
+		if e.drop {
+			return nil
+		}
+		if err := s.exec(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s ifStmt) exec(e *scriptEnv) error {
+	v, err := s.cond.eval(e)
+	if err != nil {
+		return err
+	}
+	if toBool(v) {
+		return execStmts(e, s.then)
+	}
+	return execStmts(e, s.els)
+}
+
+func (s dropStmt) exec(e *scriptEnv) error {
+	e.drop = true
+	return nil
+}
+
+func (s deleteStmt) exec(e *scriptEnv) error {
+	result := e.trap.packet[:0:0]
+	for _, p := range e.trap.packet {
+		if p.name != s.name {
+			result = append(result, p)
+		}
+	}
+	e.trap.packet = result
+	return e.step()
+}
+
+func (s assignStmt) exec(e *scriptEnv) error {
+	v, err := s.value.eval(e)
+	if err != nil {
+		return err
+	}
+	value := toString(v)
+
+	if s.field {
+		switch s.name {
+		case "name":
+			e.trap.name = value
+		case "lastdigit":
+			e.trap.lastDigit = value
+		case "ifIndex":
+			e.trap.ifIndex = value
+			e.trap.index = []string{value}
+		case "host":
+			e.trap.host = value
+		}
+		return e.step()
+	}
+
+	packet := make([]snmpPacket, len(e.trap.packet), len(e.trap.packet)+1) // Не изменяем исходный слайс
+	copy(packet, e.trap.packet)
+	e.trap.packet = packet
+	for i := range e.trap.packet {
+		if e.trap.packet[i].name == s.name {
+			e.trap.packet[i].value = value
+			return e.step()
+		}
+	}
+	e.trap.packet = append(e.trap.packet, snmpPacket{name: s.name, value: value, asn1BER: snmp.OctetString})
+
+	return e.step()
+}
+
+// Выражения
+
+type constExpr struct {
+	v scriptValue
+}
+
+type varExpr struct {
+	name string
+}
+
+type rawExpr struct {
+	name string
+}
+
+type fieldExpr struct {
+	name string
+}
+
+type unaryExpr struct {
+	op string
+	x  scriptExpr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right scriptExpr
+}
+
+type callExpr struct {
+	name string
+	f    func(args []scriptValue) (scriptValue, error)
+	args []scriptExpr
+}
+
+func (x constExpr) eval(e *scriptEnv) (scriptValue, error) {
+	return x.v, e.step()
+}
+
+func (x varExpr) eval(e *scriptEnv) (scriptValue, error) {
+	return e.get(x.name), e.step()
+}
+
+func (x rawExpr) eval(e *scriptEnv) (scriptValue, error) {
+	for _, p := range e.trap.packet {
+		if p.name == x.name {
+			if p.raw != "" {
+				return p.raw, e.step()
+			}
+			return p.value, e.step()
+		}
+	}
+	return "", e.step()
+}
+
+func (x fieldExpr) eval(e *scriptEnv) (scriptValue, error) {
+	switch x.name {
+	case "source":
+		return e.trap.addr.IP.String(), e.step()
+	case "name":
+		return e.trap.name, e.step()
+	case "oid":
+		return e.trap.oid, e.step()
+	case "ifIndex":
+		return e.trap.ifIndex, e.step()
+	case "lastdigit":
+		return e.trap.lastDigit, e.step()
+	case "host":
+		return e.trap.host, e.step()
+	}
+	return "", e.step()
+}
+
+func (x unaryExpr) eval(e *scriptEnv) (scriptValue, error) {
+	v, err := x.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if x.op == "!" {
+		return !toBool(v), nil
+	}
+	n, err := toNumber(v)
+	return -n, err
+}
+
+func (x binaryExpr) eval(e *scriptEnv) (scriptValue, error) {
+	l, err := x.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.op { // Сокращённое вычисление
+	case "&&":
+		if !toBool(l) {
+			return false, nil
+		}
+		r, err := x.right.eval(e)
+		return toBool(r), err
+	case "||":
+		if toBool(l) {
+			return true, nil
+		}
+		r, err := x.right.eval(e)
+		return toBool(r), err
+	}
+
+	r, err := x.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, lerr := toNumber(l)
+	rn, rerr := toNumber(r)
+	numeric := lerr == nil && rerr == nil
+
+	switch x.op {
+	case "==", "!=":
+		eq := toString(l) == toString(r)
+		if numeric {
+			eq = ln == rn
+		}
+		return eq == (x.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		c := strings.Compare(toString(l), toString(r))
+		if numeric {
+			c = 0
+			if ln < rn {
+				c = -1
+			} else if ln > rn {
+				c = 1
+			}
+		}
+		switch x.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "+":
+		if numeric {
+			return ln + rn, nil
+		}
+		return toString(l) + toString(r), nil
+	}
+
+	if !numeric {
+		return nil, fmt.Errorf("operator %s: not a number: %q %q", x.op, toString(l), toString(r))
+	}
+
+	switch x.op {
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		if rn == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return ln / rn, nil
+	}
+
+	li, err := toInt(ln)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %v", x.op, err)
+	}
+	ri, err := toInt(rn)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %v", x.op, err)
+	}
+
+	switch x.op {
+	case "%":
+		if ri == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(li % ri), nil
+	case "&":
+		return float64(li & ri), nil
+	case "|":
+		return float64(li | ri), nil
+	case "^":
+		return float64(li ^ ri), nil
+	case "<<", ">>":
+		if ri < 0 || ri > 63 {
+			return nil, fmt.Errorf("operator %s: shift out of range: %d", x.op, ri)
+		}
+		if x.op == "<<" {
+			return float64(li << uint(ri)), nil
+		}
+		return float64(li >> uint(ri)), nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", x.op)
+}
+
+func (x callExpr) eval(e *scriptEnv) (scriptValue, error) {
+	args := make([]scriptValue, 0, len(x.args))
+	for _, a := range x.args {
+		v, err := a.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	// Время функции зависит от длины строк, а не от числа шагов: проверка до и после каждого вызова
+	if err := e.checkDeadline(); err != nil {
+		return nil, err
+	}
+
+	v, err := x.f(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", x.name, err)
+	}
+	return v, e.checkDeadline()
+}
+
+// Преобразования значений
+
+func toString(v scriptValue) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1e15 {
+			return strconv.FormatInt(int64(x), 10)
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return ""
+}
+
+// Число из значения. NaN и бесконечность (ParseFloat принимает "NaN" и "Inf" от устройства) - не числа
+func toNumber(v scriptValue) (float64, error) {
+	var n float64
+	switch x := v.(type) {
+	case float64:
+		n = x
+	case bool:
+		if x {
+			n = 1
+		}
+	case string:
+		var err error
+		if n, err = parseScriptNumber(strings.TrimSpace(x)); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("not a number")
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("not a finite number: %v", n)
+	}
+	return n, nil
+}
+
+// Целое для индексов, сдвигов и битовых операций
+func toInt(v scriptValue) (int64, error) {
+	n, err := toNumber(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < -scriptMaxInt || n > scriptMaxInt {
+		return 0, fmt.Errorf("number out of range: %v", n)
+	}
+	return int64(n), nil
+}
+
+func toBool(v scriptValue) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != "" && x != "0" && x != "false"
+	}
+	return false
+}
+
+// Функции
+
+type scriptFunc struct {
+	args int
+	f    func(args []scriptValue) (scriptValue, error)
+}
+
+var (
+	// Поля трапа, доступные для присваивания
+	scriptFields = map[string]bool{"name": true, "lastdigit": true, "ifIndex": true, "host": true}
+
+	scriptFuncs map[string]scriptFunc
+
+	scriptRegexps scriptRegexpsType
+)
+
+// Кэш регулярных выражений из значений переменных: не компилировать при каждом трапе
+type scriptRegexpsType struct {
+	re map[string]*regexp.Regexp
+
+	sync.Mutex
+}
+
+func (r *scriptRegexpsType) get(pattern string) (*regexp.Regexp, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if re, have := r.re[pattern]; have {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if r.re == nil || len(r.re) >= scriptMaxRegexps {
+		r.re = make(map[string]*regexp.Regexp)
+	}
+	r.re[pattern] = re
+
+	return re, nil
+}
+
+func init() {
+	str := func(f func(s string) scriptValue) scriptFunc {
+		return scriptFunc{1, func(a []scriptValue) (scriptValue, error) { return f(toString(a[0])), nil }}
+	}
+	str2 := func(f func(s, t string) scriptValue) scriptFunc {
+		return scriptFunc{2, func(a []scriptValue) (scriptValue, error) { return f(toString(a[0]), toString(a[1])), nil }}
+	}
+
+	scriptFuncs = map[string]scriptFunc{
+		"str":       str(func(s string) scriptValue { return s }),
+		"len":       str(func(s string) scriptValue { return float64(len([]rune(s))) }),
+		"lower":     str(func(s string) scriptValue { return strings.ToLower(s) }),
+		"upper":     str(func(s string) scriptValue { return strings.ToUpper(s) }),
+		"trim":      str(func(s string) scriptValue { return strings.TrimSpace(s) }),
+		"hex":       str(func(s string) scriptValue { return fmt.Sprintf("%X", s) }),
+		"contains":  str2(func(s, t string) scriptValue { return strings.Contains(s, t) }),
+		"hasPrefix": str2(func(s, t string) scriptValue { return strings.HasPrefix(s, t) }),
+		"hasSuffix": str2(func(s, t string) scriptValue { return strings.HasSuffix(s, t) }),
+		"int": {1, func(a []scriptValue) (scriptValue, error) {
+			n, err := toNumber(a[0])
+			return math.Trunc(n), err
+		}},
+		"replace": {3, func(a []scriptValue) (scriptValue, error) {
+			return strings.ReplaceAll(toString(a[0]), toString(a[1]), toString(a[2])), nil
+		}},
+		"substr": {3, func(a []scriptValue) (scriptValue, error) { // Подстрока по символам: substr(s, начало, длина)
+			r := []rune(toString(a[0]))
+			start, err := toInt(a[1])
+			if err != nil {
+				return nil, err
+			}
+			n, err := toInt(a[2])
+			if err != nil {
+				return nil, err
+			}
+			from, to := start, start+n
+			if from < 0 {
+				from = 0
+			}
+			if from > int64(len(r)) {
+				from = int64(len(r))
+			}
+			if to > int64(len(r)) {
+				to = int64(len(r))
+			}
+			if to < from {
+				to = from
+			}
+			return string(r[from:to]), nil
+		}},
+		"match": {2, func(a []scriptValue) (scriptValue, error) { // Регулярное выражение RE2, время линейное
+			re, err := scriptRegexps.get(toString(a[1]))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(toString(a[0])), nil
+		}},
+		"byte": {2, func(a []scriptValue) (scriptValue, error) { // Байт строки (OctetString) по номеру с 0, для битовых масок
+			s := toString(a[0])
+			i, err := toInt(a[1])
+			if err != nil {
+				return nil, err
+			}
+			if i < 0 || i >= int64(len(s)) {
+				return float64(0), nil
+			}
+			return float64(s[i]), nil
+		}},
+		"bit": {2, func(a []scriptValue) (scriptValue, error) { // Бит числа по номеру с 0 (младший)
+			x, err := toInt(a[0])
+			if err != nil {
+				return nil, err
+			}
+			n, err := toInt(a[1])
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > 63 {
+				return false, nil
+			}
+			return x>>uint(n)&1 == 1, nil
+		}},
+	}
+}
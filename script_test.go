@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testScriptTrap(vars ...string) trapConverted {
+	var trap trapConverted
+	for i := 0; i+1 < len(vars); i += 2 {
+		trap.packet = append(trap.packet, snmpPacket{name: vars[i], value: vars[i+1]})
+	}
+	return trap
+}
+
+func TestScriptExec(t *testing.T) {
+	tests := []struct {
+		src     string
+		vars    []string
+		want    string // Значение $x после выполнения
+		wantErr bool
+	}{
+		{`$x = substr($a, 1, 3)`, []string{"a", "hello"}, "ell", false},
+		{`$x = substr($a, -5, 7)`, []string{"a", "hello"}, "he", false},
+		{`$x = substr($a, 3, -1)`, []string{"a", "hello"}, "", false},
+		{`$x = substr($a, $b, 2)`, []string{"a", "hello", "b", "NaN"}, "", true},
+		{`$x = substr($a, $b, 2)`, []string{"a", "hello", "b", "-Inf"}, "", true},
+		{`$x = substr($a, 0, $b)`, []string{"a", "hello", "b", "1e300"}, "", true},
+		{`$x = byte($a, 1)`, []string{"a", "AB"}, "66", false},
+		{`$x = byte($a, $b)`, []string{"a", "AB", "b", "Inf"}, "", true},
+		{`$x = byte($a, 9)`, []string{"a", "AB"}, "0", false},
+		{`$x = bit(5, 2)`, nil, "true", false},
+		{`$x = bit(5, 99)`, nil, "false", false},
+		{`$x = bit($a, 0)`, []string{"a", "NaN"}, "", true},
+		{`$x = 7 % $a`, []string{"a", "NaN"}, "", true},
+		{`$x = 1 << 70`, nil, "", true},
+		{`$x = 1 << 4`, nil, "16", false},
+		{`$x = $a + 1`, []string{"a", "NaN"}, "NaN1", false},
+		{`$x = 7 % 0`, nil, "", true},
+		{`$x = match($a, "^ab+$")`, []string{"a", "abb"}, "true", false},
+		{`$x = match($a, $b)`, []string{"a", "abc", "b", "^b"}, "false", false},
+		{`$x = match($a, $b)`, []string{"a", "abc", "b", "("}, "", true},
+	}
+
+	for _, tt := range tests {
+		stmts, err := parseScript(tt.src)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tt.src, err)
+		}
+		sc := &scriptType{name: "test", timeout: scriptDefaultTimeout, stmts: stmts}
+		trap := testScriptTrap(tt.vars...)
+
+		_, err = sc.exec(&trap)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %v: error %v, want error %v", tt.src, tt.vars, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		env := scriptEnv{trap: &trap}
+		if got := env.get("x"); got != tt.want {
+			t.Errorf("%s %v: $x = %q, want %q", tt.src, tt.vars, got, tt.want)
+		}
+	}
+}
+
+// Ошибка в константном регулярном выражении находится при загрузке сценария
+func TestScriptParseMatch(t *testing.T) {
+	if _, err := parseScript(`$x = match($a, "(")`); err == nil {
+		t.Error("invalid regexp accepted")
+	}
+}
+
+// Время проверяется при каждом вызове функции, а не только раз в 64 шага
+func TestScriptCallDeadline(t *testing.T) {
+	stmts, err := parseScript(`$x = match($a, "b")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trap := testScriptTrap("a", "abc")
+	env := scriptEnv{trap: &trap, deadline: time.Now().Add(-time.Second)}
+
+	if err := execStmts(&env, stmts); !errors.Is(err, errScriptTimeout) {
+		t.Errorf("exec = %v, want %v", err, errScriptTimeout)
+	}
+}
+
+// Паника в интерпретаторе возвращается как ошибка сценария
+func TestScriptExecRecover(t *testing.T) {
+	sc := &scriptType{name: "test", timeout: scriptDefaultTimeout, stmts: []scriptStmt{panicStmt{}}}
+	trap := testScriptTrap("a", "1")
+
+	dropped, err := sc.exec(&trap)
+	if err == nil || dropped {
+		t.Fatalf("exec = %v, %v, want error", dropped, err)
+	}
+	if trap.packet[0].value != "1" {
+		t.Errorf("trap changed after panic")
+	}
+}
+
+type panicStmt struct{}
+
+func (panicStmt) exec(e *scriptEnv) error {
+	var s []int
+	_ = s[len(e.trap.packet)]
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scriptDefaultTimeout = 10 * time.Millisecond
+	scriptMaxTimeout     = time.Second
+)
+
+var (
+	scripts scriptsType
+)
+
+// Сценарий из каталога --scripts. Заголовок: строки "#oid <префикс OID трапа>" и "#timeout <время>"
+type scriptType struct {
+	name    string
+	oids    []string
+	timeout time.Duration
+	stmts   []scriptStmt
+}
+
+// Счётчики выполнения сценария в /status
+type scriptStatType struct {
+	Runs      uint64 `json:"runs"`
+	Errors    uint64 `json:"errors"`
+	Timeouts  uint64 `json:"timeouts"`
+	Dropped   uint64 `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type scriptsType struct {
+	byName     map[string]*scriptType
+	byOid      map[string][]*scriptType // Префикс OID трапа: сценарии по имени
+	stat       map[string]*scriptStatType
+	lastChange time.Time
+	files      int
+	statMu     sync.Mutex // Счётчики изменяются под RLock
+
+	sync.RWMutex
+}
+
+func init() {
+	scripts.byName = make(map[string]*scriptType)
+	scripts.byOid = make(map[string][]*scriptType)
+	scripts.stat = make(map[string]*scriptStatType)
+}
+
+// Загрузка сценариев из каталога при изменении файлов. Сценарий с ошибкой не загружается
+func (s *scriptsType) load() {
+	entries, err := os.ReadDir(dirScripts)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't Read dir %s\n", dirScripts)
+		}
+		return
+	}
+
+	var lastChange time.Time
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(lastChange) {
+			lastChange = fi.ModTime()
+		}
+		files = append(files, e.Name())
+	}
+
+	if lastChange == s.lastChange && len(files) == s.files { // Файлы не изменились
+		return
+	}
+	s.lastChange = lastChange
+	s.files = len(files)
+
+	sort.Strings(files)
+	byName := make(map[string]*scriptType)
+	byOid := make(map[string][]*scriptType)
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(dirScripts, f))
+		if err != nil {
+			log.Printf("Can't Read file %s\n", f)
+			continue
+		}
+		sc, err := parseScriptFile(f, string(b))
+		if err != nil {
+			log.Printf("ERROR: script %s: %+v\n", f, err)
+			continue
+		}
+		byName[sc.name] = sc
+		for _, oid := range sc.oids {
+			byOid[oid] = append(byOid[oid], sc)
+		}
+	}
+
+	s.Lock()
+	s.byName = byName
+	s.byOid = byOid
+	for name := range s.stat {
+		if _, have := byName[name]; !have {
+			delete(s.stat, name)
+		}
+	}
+	for name := range byName {
+		if _, have := s.stat[name]; !have {
+			s.stat[name] = &scriptStatType{}
+		}
+	}
+	s.Unlock()
+
+	log.Printf("Scripts: loaded %d from %s\n", len(byName), dirScripts)
+}
+
+func parseScriptFile(name, src string) (*scriptType, error) {
+	sc := &scriptType{name: name, timeout: scriptDefaultTimeout}
+
+	sn := bufio.NewScanner(strings.NewReader(src))
+	for sn.Scan() {
+		f := strings.Fields(sn.Text())
+		if len(f) != 2 {
+			continue
+		}
+		switch f[0] {
+		case "#oid":
+			oid := f[1]
+			if oid[0] != '.' {
+				oid = "." + oid
+			}
+			sc.oids = append(sc.oids, oid)
+		case "#timeout":
+			t, err := time.ParseDuration(f[1])
+			if err != nil || t <= 0 || t > scriptMaxTimeout {
+				return nil, errors.New("wrong timeout " + f[1])
+			}
+			sc.timeout = t
+		}
+	}
+
+	var err error
+	sc.stmts, err = parseScript(src)
+
+	return sc, err
+}
+
+// Переменную с таким именем присваивает какой-либо сценарий: $name = ...
+func (s *scriptsType) sets(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, sc := range s.byName {
+		if assigns(sc.stmts, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func assigns(stmts []scriptStmt, name string) bool {
+	for _, st := range stmts {
+		switch st := st.(type) {
+		case assignStmt:
+			if !st.field && st.name == name {
+				return true
+			}
+		case ifStmt:
+			if assigns(st.then, name) || assigns(st.els, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Выполнение сценариев для префиксов OID трапа, от короткого к длинному. false - трап отброшен
+func (s *scriptsType) run(trap *trapConverted) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.byOid) == 0 {
+		return true
+	}
+
+	for i := 0; i < len(trap.oid); i++ {
+		if i < len(trap.oid)-1 && trap.oid[i+1] != '.' {
+			continue
+		}
+		for _, sc := range s.byOid[trap.oid[:i+1]] {
+			dropped, err := sc.exec(trap)
+			s.count(sc.name, dropped, err)
+			if err != nil {
+				if debug {
+					log.Printf("Script %s: trap %s from %s: %+v\n", sc.name, trap.oid, trap.addr.IP.String(), err)
+				}
+				continue
+			}
+			if dropped {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Сценарий изменяет копию трапа, при ошибке трап остаётся без изменений
+func (sc *scriptType) exec(trap *trapConverted) (dropped bool, err error) {
+	defer func() { // Ошибка интерпретатора - ошибка сценария, обработка трапов продолжается
+		if r := recover(); r != nil {
+			dropped, err = false, fmt.Errorf("script panic: %v", r)
+		}
+	}()
+
+	result := *trap
+	env := scriptEnv{trap: &result, deadline: time.Now().Add(sc.timeout)}
+
+	if err = execStmts(&env, sc.stmts); err != nil {
+		return false, err
+	}
+	if time.Now().After(env.deadline) {
+		return false, errScriptTimeout
+	}
+
+	*trap = result
+
+	return env.drop, nil
+}
+
+// Вызывается под RLock
+func (s *scriptsType) count(name string, dropped bool, err error) {
+	st := s.stat[name]
+	if st == nil {
+		return
+	}
+
+	s.statMu.Lock()
+	defer s.statMu.Unlock()
+
+	st.Runs++
+	switch {
+	case errors.Is(err, errScriptTimeout) || errors.Is(err, errScriptSteps):
+		st.Timeouts++
+		st.Errors++
+		st.LastError = err.Error()
+	case err != nil:
+		st.Errors++
+		st.LastError = err.Error()
+	case dropped:
+		st.Dropped++
+	}
+}
+
+func (s *scriptsType) stats() map[string]scriptStatType {
+	s.RLock()
+	defer s.RUnlock()
+	s.statMu.Lock()
+	defer s.statMu.Unlock()
+
+	result := make(map[string]scriptStatType, len(s.stat))
+	for name, st := range s.stat {
+		result[name] = *st
+	}
+
+	return result
+}
+
+// Трап для проверки сценария через REST
+type scriptTestTrap struct {
+	Source  string          `json:"source"`
+	Name    string          `json:"name"`
+	Oid     string          `json:"oid"`
+	IfIndex string          `json:"ifIndex"`
+	Host    string          `json:"host,omitempty"`
+	Vars    []scriptTestVar `json:"vars"`
+}
+
+type scriptTestVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type scriptTestRequest struct {
+	Script string         `json:"script"` // Имя загруженного сценария
+	Source string         `json:"source"` // Или текст сценария
+	Trap   scriptTestTrap `json:"trap"`
+}
+
+type scriptTestResponse struct {
+	Dropped bool           `json:"dropped"`
+	Error   string         `json:"error,omitempty"`
+	Trap    scriptTestTrap `json:"trap"`
+}
+
+// POST /scripts/test: выполнение сценария на примере трапа без отправки и без учёта в счётчиках
+func scriptTest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req scriptTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sc *scriptType
+	if req.Source != "" {
+		var err error
+		if sc, err = parseScriptFile("test", req.Source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		scripts.RLock()
+		sc = scripts.byName[req.Script]
+		scripts.RUnlock()
+		if sc == nil {
+			http.Error(w, "script not found: "+req.Script, http.StatusNotFound)
+			return
+		}
+	}
+
+	var trap trapConverted
+	trap.time = time.Now()
+	trap.addr = net.UDPAddr{IP: net.ParseIP(req.Trap.Source)}
+	trap.name = req.Trap.Name
+	trap.oid = req.Trap.Oid
+	trap.lastDigit = lastDigit(req.Trap.Oid)
+	trap.ifIndex = req.Trap.IfIndex
+	trap.host = req.Trap.Host
+	for _, v := range req.Trap.Vars {
+		trap.packet = append(trap.packet, snmpPacket{name: v.Name, value: v.Value, raw: v.Value})
+	}
+
+	var resp scriptTestResponse
+	dropped, err := sc.exec(&trap)
+	resp.Dropped = dropped
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Trap = scriptTestTrap{
+		Source:  trap.addr.IP.String(),
+		Name:    trap.name,
+		Oid:     trap.oid,
+		IfIndex: trap.ifIndex,
+		Host:    trap.host,
+		Vars:    make([]scriptTestVar, 0, len(trap.packet)),
+	}
+	for _, p := range trap.packet {
+		resp.Trap.Vars = append(resp.Trap.Vars, scriptTestVar{Name: p.name, Value: p.value})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -2,20 +2,20 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net"
 	"regexp"
 	"strconv"
 	"time"
 )
 
+const (
+	sendTimeout = 30 * time.Second // Весь обмен с прокси: подключение, TLS, пакет и ответ
+)
+
 var (
-	header = []byte("ZBXD\x01")
+	header = []byte("ZBXD")
 )
 
 // Single Zabbix data item.
@@ -42,15 +42,14 @@ type Response struct {
 
 var infoRE = regexp.MustCompile(`processed: (\d+); failed: (\d+); total: .*; seconds spent: (\d+\.\d+)`)
 
-func trapSender(ch <-chan trapToSend) {
+func trapSender(proxyName string, ch <-chan trapToSend) {
 	var di DataItems = make(DataItems, 0)
 	var diNew DataItems = make(DataItems, 0)
 	var trap trapToSend
-	var res *Response
-	var err error
 	var ok bool
 
 	di = nil
+	sp := spools.get(proxyName)
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -60,20 +59,19 @@ func trapSender(ch <-chan trapToSend) {
 	// }
 
 	for {
-		select { // К сожалению нет возможности указать 2 условия на одни и те же действия - просто скопировал
+		select {
 		case trap, ok = <-ch:
 			if !ok {
+				if di != nil { // Прокси удалён, пакет остаётся в буфере до его возвращения
+					sp.push(di)
+				}
 				return
 			}
 
 			diNew = makeDataItems(trap)
 			if len(di)+len(diNew) > 128 {
-				res, err = send(proxies.addr(trap.proxy), di)
+				sendBatch(proxyName, sp, di)
 				di = nil
-
-				if debug {
-					fmt.Printf("Send response: %+v\nErr: %+v\n", res, err)
-				}
 			}
 			di = append(di, diNew...)
 
@@ -89,56 +87,40 @@ func trapSender(ch <-chan trapToSend) {
 			}
 
 		case <-ticker.C:
-			// if debug {
-			// 	log.Println("Ticker", trap.proxy)
-			// }
-			if di != nil && trap.proxy != "" {
-				res, err = send(proxies.addr(trap.proxy), di)
-
+			if di != nil {
 				if debug {
 					fmt.Printf("\nTime out for send!!!\n")
 					for _, d := range di {
 						fmt.Printf("proxy %+v\ntime %+v\naddr %+v\ntrapName %+v\nValue %+v\n",
-							trap.proxy, d.Timestamp, d.Hostname, d.Key, d.Value)
+							proxyName, d.Timestamp, d.Hostname, d.Key, d.Value)
 					}
-					fmt.Printf("Send response: %+v\nErr: %+v\n", res, err)
-				}
-
-				if err == nil {
-					di = nil
 				}
-
-				// if debug {
-				// fmt.Printf("\nTime out for send!!!\nproxy %+v\ntime %+v\naddr %+v\ntrapName %+v\nlastDigit %v\nifIndex %v",
-				// 	trap.proxy, trap.time, trap.addr.IP, trap.trapName, trap.trapLastDigit, trap.ifIndex)
-				// for _, p := range trap.packet {
-				// 	// fmt.Printf("var oid %+v name %+v value %+v\n", p.oid, p.name, p.value)
-				// 	if p.name == "ifDesc" {
-				// 		fmt.Printf(" %+v\n", p.value)
-				// 	}
-				// }
-				// fmt.Printf("Send response: %+v\nErr: %+v\n", res, err)
-				// }
+				sendBatch(proxyName, sp, di)
+				di = nil
 			}
+			sp.replay(proxyName)
 		}
 	}
 }
 
-func makeValues(trap trapToSend) string {
-	var kv map[string]string = make(map[string]string)
-
-	kv["lastdigit"] = trap.lastDigit
-	for _, i := range trap.packet {
-		kv[i.name] = i.value
+// Отправка пакета на прокси. При ошибке пакет записывается в буфер на диске,
+// при непустом буфере - сразу в буфер, чтобы сохранить порядок
+func sendBatch(proxyName string, sp *spoolType, di DataItems) {
+	if !sp.empty() {
+		sp.push(di)
+		return
 	}
 
-	b, err := json.Marshal(kv)
+	res, err := send(proxyName, di)
+	if debug {
+		fmt.Printf("Send response: %+v\nErr: %+v\n", res, err)
+	}
 	if err != nil {
-		log.Printf("JSON Error: %+v\nTried encoding: %+v\n", err, kv)
-		return ""
+		sp.push(di)
+		return
 	}
 
-	return string(b)
+	replay.setDelivered(proxyName, di.lastTime())
 }
 
 func makeDataItems(trap trapToSend) DataItems {
@@ -146,16 +128,23 @@ func makeDataItems(trap trapToSend) DataItems {
 
 	di := make(DataItems, 0) // Потом увеличить в зависимости от количества сообщений. Пока 1
 
-	for _, hostname := range hosts.hostNames(trap.addr, trap.proxy) {
+	hostnames := hosts.hostNames(trap.addr, trap.proxy)
+	if trap.host != "" {
+		hostnames = []string{trap.host}
+	}
+
+	for _, hostname := range hostnames {
 		d.Hostname = hostname
-		if trap.ifIndex != "" {
-			d.Key = trap.name + "[" + trap.ifIndex + "]"
+		if trap.key != nil {
+			d.Key = trap.key.render(trap, hostname)
+		} else if len(trap.index) > 0 {
+			d.Key = trap.name + "[" + indexKeyParams(trap.index) + "]"
 		} else {
 			d.Key = trap.name
 		}
 		d.Timestamp = trap.time.Unix()
 		d.Nanoseconds = trap.time.Nanosecond()
-		d.Value = makeValues(trap)
+		d.Value = makeValues(trap, hostname)
 		di = append(di, d)
 	}
 
@@ -167,72 +156,72 @@ func makeDataItems(trap trapToSend) DataItems {
 	return di
 }
 
-func (di DataItems) marshal() (b []byte, err error) {
+// Время самого позднего трапа в пакете
+func (di DataItems) lastTime() (t time.Time) {
+	for _, d := range di {
+		if dt := time.Unix(d.Timestamp, int64(d.Nanoseconds)); dt.After(t) {
+			t = dt
+		}
+	}
+	return
+}
+
+func (di DataItems) marshal(compress bool) (b []byte, err error) {
 	d, err := json.Marshal(di)
 	if err == nil {
 		// the order of fields in this "JSON" is important - request should be before data
 		t := time.Now()
 		nowt := fmt.Sprint(t.Unix())
 		nows := fmt.Sprint(t.Nanosecond())
-		datalen := uint64(len(d) + len(nowt) + len(nows) + 48) // 32 + d + 9 + nowt + 6 + nows + 1
-		b = make([]byte, 0, datalen+13)                        // datalen + 5 + 8
-		buf := bytes.NewBuffer(b)
-		buf.Write(header)                                     // 5
-		err = binary.Write(buf, binary.LittleEndian, datalen) // 8
-		buf.WriteString(`{"request":"sender data","data":`)   // 32
-		buf.Write(d)                                          // d
-		buf.WriteString(`,"clock":`)                          // 9
-		buf.WriteString(nowt)                                 // now
-		buf.WriteString(`,"ns":`)                             // 6
-		buf.WriteString(nows)                                 // nanoseconds
-		buf.WriteByte('}')                                    // 1
-		b = buf.Bytes()
+		datalen := len(d) + len(nowt) + len(nows) + 48 // 32 + d + 9 + nowt + 6 + nows + 1
+		buf := bytes.NewBuffer(make([]byte, 0, datalen))
+		buf.WriteString(`{"request":"sender data","data":`) // 32
+		buf.Write(d)                                        // d
+		buf.WriteString(`,"clock":`)                        // 9
+		buf.WriteString(nowt)                               // now
+		buf.WriteString(`,"ns":`)                           // 6
+		buf.WriteString(nows)                               // nanoseconds
+		buf.WriteByte('}')                                  // 1
+		b, err = zbxPacket(buf.Bytes(), compress)
 	}
 	return
 }
 
-func send(addr net.TCPAddr, di DataItems) (res *Response, err error) {
+// Отправка пакета на прокси. В режиме сжатия auto пакет повторяется без сжатия, только если прокси
+// его отверг. При других ошибках пакет мог быть принят и повторяется из буфера spool
+func send(proxyName string, di DataItems) (res *Response, err error) {
+	mode, compress := compression.get(proxyName)
 
-	b, err := di.marshal()
-	if err != nil {
-		return
+	res, err = sendTo(proxyName, di, compress)
+	if err != nil && compress && mode == compressAuto && rejected(err) {
+		compression.fallback(proxyName, err)
+		res, err = sendTo(proxyName, di, false)
 	}
 
-	// Zabbix doesn't support persistent connections, so open/close it every time.
-	conn, err := net.DialTCP(addr.Network(), nil, &addr)
-	if err != nil {
-		return
-	}
-	defer conn.Close()
+	return
+}
 
-	_, err = conn.Write(b)
-	if err != nil {
-		return
-	}
+func sendTo(proxyName string, di DataItems, compress bool) (res *Response, err error) {
 
-	buf := make([]byte, 8)
-	_, err = io.ReadFull(conn, buf[:5])
+	b, err := di.marshal(compress)
 	if err != nil {
 		return
 	}
-	if !bytes.Equal(buf[:5], header) {
-		err = ErrBadHeader
-		return
-	}
 
-	_, err = io.ReadFull(conn, buf)
+	// Zabbix doesn't support persistent connections, so open/close it every time.
+	conn, err := dialProxy(proxyName, proxies.addr(proxyName), time.Now().Add(sendTimeout))
 	if err != nil {
 		return
 	}
-	var datalen uint64
-	err = binary.Read(bytes.NewBuffer(buf), binary.LittleEndian, &datalen)
-	if err != nil {
-		err = ErrBadHeader
+	defer conn.Close()
+
+	_, err = conn.Write(b)
+	if err != nil { // Пакет передан не полностью и не может быть принят
+		err = fmt.Errorf("%w: %v", ErrNotAccepted, err)
 		return
 	}
 
-	buf = make([]byte, datalen)
-	_, err = io.ReadFull(conn, buf)
+	buf, err := zbxRead(conn)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentSize      = 4 * 1024 * 1024 // Размер сегмента журнала, после которого начинается новый
+	spoolDefaultMaxSize   = 100             // МБ на прокси
+	spoolDefaultMaxAge    = 86400           // Секунд
+	spoolDefaultBackoff   = 300             // Максимальный интервал повтора, секунд
+	spoolReplayBatches    = 100             // Пакетов за одну попытку отправки
+	spoolHeadFile         = "head"
+	spoolSegmentExtension = ".seg"
+)
+
+var (
+	spools spoolsType
+)
+
+// Параметры буфера неотправленных пакетов в cred.json
+type configSpool struct {
+	MaxSize    int64 `json:"max_size"`    // МБ на прокси, при превышении удаляются самые старые пакеты
+	MaxAge     int   `json:"max_age"`     // Секунд, более старые пакеты удаляются
+	BackoffMax int   `json:"backoff_max"` // Максимальный интервал повтора отправки, секунд
+}
+
+// Пакет в сегменте журнала: одна строка JSON
+type spoolBatch struct {
+	Time  int64     `json:"time"`
+	Items DataItems `json:"items"`
+}
+
+// Положение пакета в журнале
+type spoolRecord struct {
+	seq   uint64
+	off   int64
+	size  int64
+	items int
+	time  time.Time
+}
+
+// Позиция первого неотправленного пакета, файл head
+type spoolPos struct {
+	Seq uint64 `json:"seq"`
+	Off int64  `json:"off"`
+}
+
+// Буфер неотправленных пакетов прокси: сегменты журнала в каталоге --spool/<прокси>
+type spoolType struct {
+	dir      string
+	records  []spoolRecord // Неотправленные пакеты по порядку
+	bytes    int64
+	head     spoolPos
+	w        *os.File // Последний сегмент для записи
+	wSeq     uint64
+	wSize    int64
+	backoff  time.Duration
+	next     time.Time // Время следующей попытки отправки
+	dropped  uint64
+	lastErr  string
+	disabled bool // Каталог недоступен, пакеты не сохраняются
+
+	sync.Mutex
+}
+
+// Состояние буфера прокси в /status
+type spoolStat struct {
+	Batches   int       `json:"batches"`
+	Items     int       `json:"items"`
+	Bytes     int64     `json:"bytes"`
+	Age       float64   `json:"age"` // Секунд с момента записи самого старого пакета
+	Dropped   uint64    `json:"dropped"`
+	NextRetry time.Time `json:"next_retry,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type spoolsType struct {
+	s   map[string]*spoolType
+	cfg configSpool
+
+	sync.RWMutex
+}
+
+func init() {
+	spools.s = make(map[string]*spoolType)
+	spools.cfg = configSpool{MaxSize: spoolDefaultMaxSize, MaxAge: spoolDefaultMaxAge, BackoffMax: spoolDefaultBackoff}
+}
+
+func (s *spoolsType) load(cfg configSpool) {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = spoolDefaultMaxSize
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = spoolDefaultMaxAge
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = spoolDefaultBackoff
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.cfg = cfg
+}
+
+func (s *spoolsType) config() configSpool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.cfg
+}
+
+// Буфер прокси, при первом обращении читается с диска
+func (s *spoolsType) get(proxyName string) *spoolType {
+	s.Lock()
+	defer s.Unlock()
+
+	if sp, have := s.s[proxyName]; have {
+		return sp
+	}
+
+	sp := &spoolType{dir: filepath.Join(dirSpool, strings.ReplaceAll(proxyName, "/", "_"))}
+	sp.open()
+	s.s[proxyName] = sp
+
+	return sp
+}
+
+// Буферы копируются под RLock, их блокировки берутся уже без неё
+func (s *spoolsType) stat() map[string]spoolStat {
+	s.RLock()
+	list := make(map[string]*spoolType, len(s.s))
+	for name, sp := range s.s {
+		list[name] = sp
+	}
+	s.RUnlock()
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	result := make(map[string]spoolStat, len(list))
+	for name, sp := range list {
+		result[name] = sp.stat()
+	}
+	return result
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%016d%s", seq, spoolSegmentExtension)
+}
+
+// Чтение журнала с позиции head. Недописанная при остановке запись отбрасывается
+func (sp *spoolType) open() {
+	if dirSpool == "" {
+		sp.disabled = true
+		return
+	}
+	if err := os.MkdirAll(sp.dir, 0755); err != nil {
+		sp.error("Spool: can't create dir "+sp.dir, err)
+		sp.disabled = true
+		return
+	}
+
+	if b, err := os.ReadFile(filepath.Join(sp.dir, spoolHeadFile)); err == nil {
+		if err := json.Unmarshal(b, &sp.head); err != nil {
+			sp.error("Spool: can't Unmarshal head "+sp.dir, err)
+		}
+	}
+
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		sp.error("Spool: can't read dir "+sp.dir, err)
+		sp.disabled = true
+		return
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spoolSegmentExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < sp.head.Seq { // Отправлен полностью
+			os.Remove(filepath.Join(sp.dir, name))
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	for _, seq := range segments {
+		sp.wSeq = seq
+		sp.wSize = sp.scan(seq)
+	}
+	if len(segments) == 0 {
+		sp.wSeq = sp.head.Seq
+	}
+
+	if len(sp.records) > 0 {
+		log.Printf("Spool: %s: %d batches to resend\n", sp.dir, len(sp.records))
+	}
+}
+
+// Индекс пакетов сегмента, возвращает размер корректной части
+func (sp *spoolType) scan(seq uint64) int64 {
+	f, err := os.Open(filepath.Join(sp.dir, segmentName(seq)))
+	if err != nil {
+		sp.error("Spool: can't read segment", err)
+		return 0
+	}
+	defer f.Close()
+
+	var off int64
+	if seq == sp.head.Seq {
+		off = sp.head.Off
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return 0
+		}
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil { // Конец файла или недописанная запись
+			return off
+		}
+		var b spoolBatch
+		if err := json.Unmarshal(line, &b); err != nil {
+			sp.error("Spool: wrong record in segment "+segmentName(seq), err)
+			return off
+		}
+		size := int64(len(line))
+		sp.records = append(sp.records, spoolRecord{seq: seq, off: off, size: size, items: len(b.Items), time: time.Unix(b.Time, 0)})
+		sp.bytes += size
+		off += size
+	}
+}
+
+func (sp *spoolType) empty() bool {
+	sp.Lock()
+	defer sp.Unlock()
+
+	return len(sp.records) == 0
+}
+
+// Запись неотправленного пакета в конец журнала
+func (sp *spoolType) push(di DataItems) {
+	cfg := spools.config() // spools не блокируется под блокировкой буфера
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	if sp.disabled {
+		log.Printf("Spool: %s disabled, %d items dropped\n", sp.dir, len(di))
+		return
+	}
+
+	line, err := json.Marshal(spoolBatch{Time: time.Now().Unix(), Items: di})
+	if err != nil {
+		sp.error("Spool: can't Marshal", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if sp.wSize > 0 && sp.wSize+int64(len(line)) > spoolSegmentSize { // Новый сегмент
+		if sp.w != nil {
+			sp.w.Close()
+			sp.w = nil
+		}
+		sp.wSeq++
+		sp.wSize = 0
+	}
+	if sp.w == nil {
+		f, err := os.OpenFile(filepath.Join(sp.dir, segmentName(sp.wSeq)), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			sp.error("Spool: can't open segment", err)
+			return
+		}
+		if sp.wSize == 0 { // Новый сегмент должен остаться в каталоге после сбоя питания
+			if err := syncDir(sp.dir); err != nil {
+				sp.error("Spool: can't sync dir", err)
+			}
+		}
+		if err := f.Truncate(sp.wSize); err != nil { // Отбрасываем недописанную запись
+			f.Close()
+			sp.error("Spool: can't truncate segment", err)
+			return
+		}
+		if _, err := f.Seek(sp.wSize, io.SeekStart); err != nil {
+			f.Close()
+			sp.error("Spool: can't seek segment", err)
+			return
+		}
+		sp.w = f
+	}
+
+	if _, err := sp.w.Write(line); err != nil { // Недописанная запись отбрасывается при следующем открытии
+		sp.error("Spool: can't write segment", err)
+		sp.w.Close()
+		sp.w = nil
+		return
+	}
+	if err := sp.w.Sync(); err != nil { // Пакет считается сохранённым только на диске, не в кэше ОС
+		sp.error("Spool: can't sync segment", err)
+		sp.w.Close()
+		sp.w = nil
+		return
+	}
+
+	size := int64(len(line))
+	sp.records = append(sp.records, spoolRecord{seq: sp.wSeq, off: sp.wSize, size: size, items: len(di), time: time.Now()})
+	sp.bytes += size
+	sp.wSize += size
+
+	sp.limit(cfg)
+}
+
+// Удаление самых старых пакетов сверх размера и возраста. Вызывается под блокировкой
+func (sp *spoolType) limit(cfg configSpool) {
+	border := time.Now().Add(-time.Duration(cfg.MaxAge) * time.Second)
+	n := 0
+	bytes := sp.bytes
+	for n < len(sp.records) && (bytes > cfg.MaxSize*1024*1024 || sp.records[n].time.Before(border)) {
+		bytes -= sp.records[n].size
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	items := 0
+	for _, r := range sp.records[:n] {
+		items += r.items
+	}
+	log.Printf("Spool: %s: dropped %d oldest batches (%d items)\n", sp.dir, n, items)
+	sp.dropped += uint64(n)
+	sp.advance(n)
+}
+
+// Удаление n первых пакетов, сохранение позиции и удаление отправленных сегментов. Вызывается под блокировкой
+func (sp *spoolType) advance(n int) {
+	firstSeq := sp.records[0].seq
+	last := sp.records[n-1]
+	for _, r := range sp.records[:n] {
+		sp.bytes -= r.size
+	}
+	sp.records = sp.records[n:]
+
+	switch {
+	case len(sp.records) > 0:
+		sp.head = spoolPos{Seq: sp.records[0].seq, Off: sp.records[0].off}
+	case sp.w != nil: // Всё отправлено: следующий пакет - в новый сегмент
+		sp.w.Close()
+		sp.w = nil
+		sp.wSeq++
+		sp.wSize = 0
+		sp.head = spoolPos{Seq: sp.wSeq}
+	default:
+		sp.head = spoolPos{Seq: last.seq, Off: last.off + last.size}
+	}
+
+	if err := sp.writeHead(); err != nil {
+		sp.error("Spool: can't write head", err)
+	}
+
+	for seq := firstSeq; seq < sp.head.Seq; seq++ {
+		if err := os.Remove(filepath.Join(sp.dir, segmentName(seq))); err != nil && !os.IsNotExist(err) {
+			sp.error("Spool: can't remove segment", err)
+		}
+	}
+}
+
+// Позиция пишется во временный файл и переименовывается: после сбоя на диске старая или новая позиция целиком.
+// Вызывается под блокировкой
+func (sp *spoolType) writeHead() error {
+	b, _ := json.Marshal(sp.head)
+	tmp := filepath.Join(sp.dir, spoolHeadFile+".tmp")
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(sp.dir, spoolHeadFile)); err != nil {
+		return err
+	}
+	return syncDir(sp.dir)
+}
+
+// Сохранение записей каталога: создания и переименования файлов
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Чтение первого пакета. Вызывается под блокировкой
+func (sp *spoolType) first() (DataItems, error) {
+	r := sp.records[0]
+
+	f, err := os.Open(filepath.Join(sp.dir, segmentName(r.seq)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line := make([]byte, r.size)
+	if _, err := f.ReadAt(line, r.off); err != nil {
+		return nil, err
+	}
+
+	var b spoolBatch
+	if err := json.Unmarshal(line, &b); err != nil {
+		return nil, err
+	}
+
+	return b.Items, nil
+}
+
+// Повторная отправка пакетов по порядку. Интервал попыток растёт вдвое после каждой ошибки.
+// Вызывается только из trapSender прокси, отправка идёт без блокировки
+func (sp *spoolType) replay(proxyName string) {
+	cfg := spools.config() // До блокировки буфера, как в push
+
+	for i := 0; i < spoolReplayBatches; i++ {
+		sp.Lock()
+		if i == 0 {
+			sp.limit(cfg)
+		}
+		if len(sp.records) == 0 || time.Now().Before(sp.next) {
+			sp.Unlock()
+			return
+		}
+		di, err := sp.first()
+		if err != nil { // Повреждённая запись не отправляется
+			sp.error("Spool: can't read batch", err)
+			sp.dropped++
+			sp.advance(1)
+			sp.Unlock()
+			continue
+		}
+		sp.Unlock()
+
+		_, err = send(proxyName, di)
+
+		sp.Lock()
+		if err != nil {
+			sp.lastErr = err.Error()
+			sp.backoff *= 2
+			if sp.backoff < time.Second {
+				sp.backoff = time.Second
+			}
+			if backoffMax := time.Duration(cfg.BackoffMax) * time.Second; sp.backoff > backoffMax {
+				sp.backoff = backoffMax
+			}
+			sp.next = time.Now().Add(sp.backoff)
+			sp.Unlock()
+			return
+		}
+		replay.setDelivered(proxyName, di.lastTime())
+		sp.advance(1)
+		sp.backoff = 0
+		sp.next = time.Time{}
+		sp.lastErr = ""
+		sp.Unlock()
+	}
+}
+
+func (sp *spoolType) error(msg string, err error) {
+	log.Println(msg, err)
+	sp.lastErr = msg + ": " + err.Error()
+}
+
+func (sp *spoolType) stat() spoolStat {
+	sp.Lock()
+	defer sp.Unlock()
+
+	st := spoolStat{
+		Batches:   len(sp.records),
+		Bytes:     sp.bytes,
+		Dropped:   sp.dropped,
+		NextRetry: sp.next,
+		LastError: sp.lastErr,
+	}
+	for _, r := range sp.records {
+		st.Items += r.items
+	}
+	if len(sp.records) > 0 {
+		st.Age = time.Since(sp.records[0].time).Seconds()
+	}
+
+	return st
+}
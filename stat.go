@@ -34,14 +34,30 @@ var (
 type statType struct {
 	Uptime           string `json:"uptime"`
 	RawTraps         uint64 `json:"received"`
+	FilteredTrapsV1  uint64 `json:"passedv1"`
 	FilteredTrapsV2  uint64 `json:"passedv2"`
 	FilteredTrapsV3  uint64 `json:"passedv3"`
 	TestTrap         uint64 `json:"testtrap"`
 	DeliveredTraps   uint64 `json:"delivered"`
 	UndeliveredTraps uint64 `json:"undelivered"`
 	LostTraps        uint64 `json:"lost"`
+	ReplayedTraps    uint64 `json:"replayed"`
+	InformsAcked     uint64 `json:"informsacked"`
+	InformDuplicates uint64 `json:"informduplicates"`
+	DeniedTraps      uint64 `json:"denied"`
+	SuppressedTraps  uint64 `json:"suppressed"`
+	DuplicateTraps   uint64 `json:"duplicates"`
+	FlappingTraps    uint64 `json:"flapping"`
+	WaitQueueDepth   int    `json:"waitqueue_depth"` // Трапов "потери" в ожидании
 	Master           bool   `json:"master"`
 
+	Listeners map[string]listenerStatType  `json:"listeners,omitempty"`
+	Malformed map[string]map[string]uint64 `json:"malformed,omitempty"` // Источник: причина: количество
+	Access    []accessRuleStat             `json:"access,omitempty"`
+	Scripts   map[string]scriptStatType    `json:"scripts,omitempty"`
+	WaitQueue *waitStoreStat               `json:"waitqueue,omitempty"`
+	Spool     map[string]spoolStat         `json:"spool,omitempty"` // Прокси: неотправленные пакеты
+
 	sync.RWMutex
 }
 
@@ -52,15 +68,17 @@ type certType struct {
 }
 
 type messageType struct {
-	HostName  string    `json:"host"`
-	LastCheck time.Time `json:"lastcheck"`
-	StartTime time.Time `json:"uptime"`
-	Status    bool      `json:"status"`
+	HostName  string               `json:"host"`
+	LastCheck time.Time            `json:"lastcheck"`
+	StartTime time.Time            `json:"uptime"`
+	Status    bool                 `json:"status"`
+	Delivered map[string]time.Time `json:"delivered_proxies,omitempty"` // Прокси: время последнего доставленного master трапа
 }
 
 type clusterType struct {
 	me             messageType
 	c              map[string]messageType
+	offset         map[string]time.Duration // Разница часов участника с нашими по healthcheck
 	isMaster       bool
 	httpClient     *http.Client
 	lastFileChange time.Time
@@ -83,6 +101,9 @@ func stat() {
 	r.HandleFunc("/setmaster", cluster.setMasterFromHttp).Methods(http.MethodGet)
 	r.HandleFunc("/healthcheck", pong).Methods(http.MethodPost)
 	r.HandleFunc("/rereadb", rereadDb).Methods(http.MethodGet)
+	r.HandleFunc("/quarantine", quarantineList).Methods(http.MethodGet)
+	r.HandleFunc("/engines/{ip}", forgetEngine).Methods(http.MethodDelete)
+	r.HandleFunc("/scripts/test", scriptTest).Methods(http.MethodPost)
 	r.HandleFunc("/proxy/{instance}/{host}/{proxy}", newProxy).Methods(http.MethodPut)
 	r.HandleFunc("/proxyfromcluster/{instance}/{host}/{proxy}", newProxyLocal).Methods(http.MethodPut)
 	handler := cors.Default().Handler(r)
@@ -244,6 +265,7 @@ func (c *clusterType) healthcheck(wg *sync.WaitGroup, name string) {
 	client := c.httpClient
 	c.RUnlock()
 
+	sent := time.Now()
 	resp, err := client.Post("https://"+name+":"+servicePort+"/healthcheck", "application/json", bytes.NewBuffer(bytesRepr))
 	if err != nil {
 		c.setStatus(name, false)
@@ -252,6 +274,7 @@ func (c *clusterType) healthcheck(wg *sync.WaitGroup, name string) {
 	defer resp.Body.Close()
 
 	resBody, err := io.ReadAll(resp.Body)
+	received := time.Now()
 	if err != nil {
 		log.Println("Healthcheck: error ReadAll:", err.Error())
 		c.setStatus(name, false)
@@ -268,7 +291,20 @@ func (c *clusterType) healthcheck(wg *sync.WaitGroup, name string) {
 		// return
 	} else {
 		cluster.update(messages)
+		if len(messages) > 0 { // Первое сообщение - ответивший участник, LastCheck - его часы в момент ответа
+			cluster.setOffset(messages[0].HostName, messages[0].LastCheck.Sub(sent.Add(received.Sub(sent)/2)))
+		}
+	}
+}
+
+func (c *clusterType) setOffset(name string, offset time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.offset == nil {
+		c.offset = make(map[string]time.Duration)
 	}
+	c.offset[name] = offset
 }
 
 // func (c *clusterType) have(s string) bool {
@@ -315,6 +351,9 @@ func (c *clusterType) response() (res []messageType) {
 	res[0].LastCheck = time.Now()
 	res[0].StartTime = c.me.StartTime
 	res[0].Status = true
+	if c.isMaster {
+		res[0].Delivered = replay.watermark()
+	}
 
 	for _, i := range c.c {
 		res = append(res, i)
@@ -362,6 +401,19 @@ func (c *clusterType) setMaster(status bool) {
 	if c.isMaster != status {
 		c.isMaster = status
 		log.Printf("Cluster: status master switched to %v\n", status)
+
+		if status { // Повторяем трапы, доставку которых прежний master не подтвердил
+			watermarks := make(map[string]time.Time)
+			for name, i := range c.c {
+				for proxy, t := range i.Delivered { // Отметки участника по нашим часам, с запасом
+					t = t.Add(-c.offset[name] - replayClockMargin)
+					if t.After(watermarks[proxy]) {
+						watermarks[proxy] = t
+					}
+				}
+			}
+			replay.start(watermarks)
+		}
 	}
 }
 
@@ -460,9 +512,37 @@ func status(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 
-	workTime := time.Since(startTime).String()
+	// Счётчики копируются под блокировкой, остальные подсистемы и запись ответа - без неё:
+	// подсистемы сами обращаются к stats под своими блокировками
 	stats.RLock()
-	defer stats.RUnlock()
+	result := statType{
+		Uptime:           time.Since(startTime).String(),
+		RawTraps:         stats.RawTraps,
+		FilteredTrapsV1:  stats.FilteredTrapsV1,
+		FilteredTrapsV2:  stats.FilteredTrapsV2,
+		FilteredTrapsV3:  stats.FilteredTrapsV3,
+		TestTrap:         stats.TestTrap,
+		LostTraps:        stats.LostTraps,
+		ReplayedTraps:    stats.ReplayedTraps,
+		DeliveredTraps:   stats.DeliveredTraps,
+		UndeliveredTraps: stats.UndeliveredTraps,
+		InformsAcked:     stats.InformsAcked,
+		InformDuplicates: stats.InformDuplicates,
+		DeniedTraps:      stats.DeniedTraps,
+		SuppressedTraps:  stats.SuppressedTraps,
+		DuplicateTraps:   stats.DuplicateTraps,
+		FlappingTraps:    stats.FlappingTraps,
+	}
+	if len(stats.Malformed) > 0 {
+		result.Malformed = make(map[string]map[string]uint64, len(stats.Malformed))
+		for source, reasons := range stats.Malformed {
+			result.Malformed[source] = make(map[string]uint64, len(reasons))
+			for reason, n := range reasons {
+				result.Malformed[source][reason] = n
+			}
+		}
+	}
+	stats.RUnlock()
 
 	// for _, z := range r.TLS.PeerCertificates {
 	// 	log.Println("Status: Subject:", z.DNSNames, z.Subject.String(), z.Subject.CommonName)
@@ -471,17 +551,15 @@ func status(w http.ResponseWriter, r *http.Request) {
 	// 	}
 	// }
 
-	_ = json.NewEncoder(w).Encode(statType{
-		Uptime:           workTime,
-		RawTraps:         stats.RawTraps,
-		FilteredTrapsV2:  stats.FilteredTrapsV2,
-		FilteredTrapsV3:  stats.FilteredTrapsV3,
-		TestTrap:         stats.TestTrap,
-		LostTraps:        stats.LostTraps,
-		DeliveredTraps:   stats.DeliveredTraps,
-		UndeliveredTraps: stats.UndeliveredTraps,
-		Master:           cluster.master(),
-	})
+	result.WaitQueueDepth = waitQueue.len()
+	result.Master = cluster.master()
+	result.Listeners = listeners.stat()
+	result.Access = access.stat()
+	result.Scripts = scripts.stats()
+	result.WaitQueue = waitStore.stats()
+	result.Spool = spools.stat()
+
+	_ = json.NewEncoder(w).Encode(&result)
 }
 
 func newProxy(w http.ResponseWriter, r *http.Request) {
@@ -531,6 +609,8 @@ func off(w http.ResponseWriter, r *http.Request) {
 
 	time.Sleep(time.Second)
 
+	waitQueue.save()
+
 	os.Exit(0)
 }
 
@@ -556,7 +636,9 @@ func (s *statType) newFilteredTrap(version int) {
 	s.Lock()
 	defer s.Unlock()
 
-	if version == 2 {
+	if version == 1 {
+		s.FilteredTrapsV1++
+	} else if version == 2 {
 		s.FilteredTrapsV2++
 	} else if version == 3 {
 		s.FilteredTrapsV3++
@@ -585,3 +667,69 @@ func (s *statType) newLostTrap() {
 
 	s.LostTraps++
 }
+
+func (s *statType) newInformAcked() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.InformsAcked++
+}
+
+func (s *statType) newInformDuplicate() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.InformDuplicates++
+}
+
+func (s *statType) newMalformedTrap(source, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Malformed == nil {
+		s.Malformed = make(map[string]map[string]uint64)
+	}
+	if _, have := s.Malformed[source]; !have && len(s.Malformed) >= malformedSources {
+		source = malformedOther
+	}
+	if s.Malformed[source] == nil {
+		s.Malformed[source] = make(map[string]uint64)
+	}
+
+	s.Malformed[source][reason]++
+}
+
+func (s *statType) newDeniedTrap() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.DeniedTraps++
+}
+
+func (s *statType) newSuppressedTrap() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.SuppressedTraps++
+}
+
+func (s *statType) newDuplicateTrap() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.DuplicateTraps++
+}
+
+func (s *statType) newFlappingTrap() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.FlappingTraps++
+}
+
+func (s *statType) newReplayedTrap() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.ReplayedTraps++
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	stormDefaultInterval = 60
+	stormDefaultKey      = "zabbixtrapd.storm"
+)
+
+var (
+	storm stormType
+)
+
+// Параметры защиты от шторма трапов в cred.json. Значения rate - трапов в секунду, 0 - без ограничения
+type configStorm struct {
+	SourceRate  float64 `json:"source_rate"`
+	SourceBurst float64 `json:"source_burst"`
+	OidRate     float64 `json:"oid_rate"`
+	OidBurst    float64 `json:"oid_burst"`
+	Interval    int     `json:"report_interval"` // Период отправки сводки о подавленных трапах, секунд
+	Key         string  `json:"report_key"`      // Ключ элемента данных сводки
+}
+
+// Token bucket
+type bucketType struct {
+	tokens float64
+	last   time.Time
+}
+
+// Подавленные трапы источника по OID трапа
+type suppressedType struct {
+	addr  net.UDPAddr
+	oid   string
+	count uint64
+}
+
+type stormType struct {
+	cfg        configStorm
+	sources    map[string]*bucketType // Ключ: IP
+	oids       map[string]*bucketType // Ключ: IP + OID трапа
+	suppressed map[string]*suppressedType
+
+	sync.Mutex
+}
+
+func init() {
+	storm.sources = make(map[string]*bucketType)
+	storm.oids = make(map[string]*bucketType)
+	storm.suppressed = make(map[string]*suppressedType)
+}
+
+func (s *stormType) load(cfg configStorm) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = stormDefaultInterval
+	}
+	if cfg.Key == "" {
+		cfg.Key = stormDefaultKey
+	}
+	if cfg.SourceBurst < cfg.SourceRate {
+		cfg.SourceBurst = cfg.SourceRate
+	}
+	if cfg.OidBurst < cfg.OidRate {
+		cfg.OidBurst = cfg.OidRate
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.cfg = cfg
+}
+
+func (b *bucketType) take(now time.Time, rate, burst float64) bool {
+	if !b.refill(now, rate, burst) {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// Пополнение на время с последнего обращения. true - есть токен
+func (b *bucketType) refill(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	return b.tokens >= 1
+}
+
+func bucket(m map[string]*bucketType, key string) *bucketType {
+	b, have := m[key]
+	if !have {
+		b = &bucketType{}
+		m[key] = b
+	}
+	return b
+}
+
+// Проверка лимитов для источника и OID трапа. Подавленные трапы учитываются для сводки
+func (s *stormType) allow(addr net.UDPAddr, oid string) bool {
+	ip := addr.IP.String()
+	key := ip + "/" + oid
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Токены берутся, только если есть в обоих: трап, подавленный по источнику, не расходует лимит OID
+	var oidBucket, sourceBucket *bucketType
+	allow := true
+	if s.cfg.OidRate > 0 {
+		oidBucket = bucket(s.oids, key)
+		allow = oidBucket.refill(now, s.cfg.OidRate, s.cfg.OidBurst)
+	}
+	if s.cfg.SourceRate > 0 {
+		sourceBucket = bucket(s.sources, ip)
+		allow = sourceBucket.refill(now, s.cfg.SourceRate, s.cfg.SourceBurst) && allow
+	}
+
+	if !allow {
+		sp, have := s.suppressed[key]
+		if !have {
+			sp = &suppressedType{addr: addr, oid: oid}
+			s.suppressed[key] = sp
+		}
+		sp.count++
+		stats.newSuppressedTrap()
+		return false
+	}
+
+	if oidBucket != nil {
+		oidBucket.tokens--
+	}
+	if sourceBucket != nil {
+		sourceBucket.tokens--
+	}
+
+	return true
+}
+
+// Периодическая отправка сводки о подавленных трапах на хост в Zabbix. Запускать в 1 поток
+func (s *stormType) reporter() {
+	for {
+		s.Lock()
+		interval := time.Duration(s.cfg.Interval) * time.Second
+		s.Unlock()
+
+		if interval <= 0 {
+			interval = stormDefaultInterval * time.Second
+		}
+		time.Sleep(interval)
+
+		for _, i := range s.pull(interval) {
+			chTrapConverted <- i
+		}
+	}
+}
+
+// Сводка подавленных трапов с последнего вызова + удаление неактивных счётчиков
+func (s *stormType) pull(idle time.Duration) (result []trapConverted) {
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for k, sp := range s.suppressed {
+		var trap trapConverted
+
+		count := strconv.FormatUint(sp.count, 10)
+
+		trap.time = now
+		trap.addr = sp.addr
+		trap.name = s.cfg.Key
+		trap.oid = sp.oid
+		trap.lastDigit = lastDigit(sp.oid)
+		trap.packet = []snmpPacket{
+			{name: "oid", value: sp.oid},
+			{name: "trap", value: trapOids.name(sp.oid)},
+			{name: "suppressed", value: count},
+			{name: "text", value: count + " traps of OID " + sp.oid + " suppressed"},
+		}
+		result = append(result, trap)
+
+		delete(s.suppressed, k)
+	}
+
+	for _, m := range []map[string]*bucketType{s.sources, s.oids} {
+		for k, b := range m {
+			if now.Sub(b.last) > idle {
+				delete(m, k)
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Режимы подключения к прокси, как TLSConnect в Zabbix
+const (
+	tlsUnencrypted = "unencrypted"
+	tlsCert        = "cert"
+	tlsPSK         = "psk"
+)
+
+var (
+	proxyTLS proxyTLSType
+)
+
+// Параметры TLS в instance.json для instance или прокси. Пустые файлы сертификатов берутся из cred.json
+type configTLS struct {
+	Connect           string `json:"connect"`             // unencrypted, cert, psk
+	CAFile            string `json:"ca_file"`             // По умолчанию cert_root
+	CertFile          string `json:"cert_file"`           // По умолчанию cert_pem
+	KeyFile           string `json:"key_file"`            // По умолчанию cert_key
+	ServerName        string `json:"server_name"`         // Имя в сертификате прокси, пустое - без проверки имени
+	ServerCertIssuer  string `json:"server_cert_issuer"`  // "CN=Root CA,O=Example"
+	ServerCertSubject string `json:"server_cert_subject"` // "CN=proxy1,O=Example"
+	PSKIdentity       string `json:"psk_identity"`
+	PSKFile           string `json:"psk_file"`
+}
+
+// Параметры прокси в instance.json
+type configProxy struct {
+	TLS *configTLS `json:"tls"`
+}
+
+// Подготовленные параметры подключения
+type tlsSettings struct {
+	connect     string
+	config      *tls.Config
+	pskIdentity string
+	pskKey      []byte
+	err         error // Ошибка конфигурации: подключение к прокси не выполняется
+}
+
+type proxyTLSType struct {
+	instances map[string]*configTLS            // instance: параметры по умолчанию
+	proxies   map[string]map[string]*configTLS // instance: прокси: параметры
+	cert      certType                         // Файлы сертификатов из cred.json
+
+	byInstance map[string]tlsSettings
+	byProxy    map[string]map[string]tlsSettings
+	files      map[string]time.Time // Файлы сертификатов и ключей для перечитки при изменении
+
+	sync.RWMutex
+}
+
+// Параметры TLS из instance.json и cred.json, вызывается при изменении файлов
+func (p *proxyTLSType) load(inst map[string]instanceZabbix, cert certType) {
+	instances := make(map[string]*configTLS)
+	proxies := make(map[string]map[string]*configTLS)
+	for name, i := range inst {
+		if i.TLS != nil {
+			instances[name] = i.TLS
+		}
+		for proxy, c := range i.Proxies {
+			if c.TLS == nil {
+				continue
+			}
+			if proxies[name] == nil {
+				proxies[name] = make(map[string]*configTLS)
+			}
+			proxies[name][proxy] = c.TLS
+		}
+	}
+
+	p.Lock()
+	p.instances = instances
+	p.proxies = proxies
+	p.cert = cert
+	p.Unlock()
+
+	p.build()
+}
+
+// Перечитка сертификатов при изменении файлов
+func (p *proxyTLSType) check() {
+	p.RLock()
+	changed := false
+	for file, mtime := range p.files {
+		if modTime(file) != mtime {
+			changed = true
+			break
+		}
+	}
+	p.RUnlock()
+
+	if changed {
+		log.Println("TLS: certificate files changed, reloading")
+		p.build()
+	}
+}
+
+func (p *proxyTLSType) build() {
+	p.RLock()
+	instances, proxies, cert := p.instances, p.proxies, p.cert
+	p.RUnlock()
+
+	files := make(map[string]time.Time)
+	byInstance := make(map[string]tlsSettings)
+	byProxy := make(map[string]map[string]tlsSettings)
+
+	for name, c := range instances {
+		byInstance[name] = c.settings(cert, files)
+		if err := byInstance[name].err; err != nil {
+			log.Printf("ERROR: TLS for instance %s: %+v\n", name, err)
+		}
+	}
+	for name, m := range proxies {
+		byProxy[name] = make(map[string]tlsSettings)
+		for proxy, c := range m {
+			byProxy[name][proxy] = c.settings(cert, files)
+			if err := byProxy[name][proxy].err; err != nil {
+				log.Printf("ERROR: TLS for proxy %s on instance %s: %+v\n", proxy, name, err)
+			}
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.byInstance = byInstance
+	p.byProxy = byProxy
+	p.files = files
+}
+
+// Параметры подключения к прокси: прокси в instance, иначе instance, иначе без шифрования
+func (p *proxyTLSType) get(proxyName string) tlsSettings {
+	instance := proxies.instance(proxyName)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	if s, have := p.byProxy[instance][proxyName]; have {
+		return s
+	}
+	if s, have := p.byInstance[instance]; have {
+		return s
+	}
+	return tlsSettings{connect: tlsUnencrypted}
+}
+
+func (c *configTLS) settings(cert certType, files map[string]time.Time) (s tlsSettings) {
+	s.connect = c.Connect
+	switch c.Connect {
+	case "", tlsUnencrypted:
+		s.connect = tlsUnencrypted
+	case tlsCert:
+		s.config, s.err = c.certConfig(cert, files)
+	case tlsPSK:
+		s.pskIdentity = c.PSKIdentity
+		s.pskKey, s.err = c.loadPSK(files)
+	default:
+		s.err = fmt.Errorf("unknown connect %q", c.Connect)
+	}
+	return
+}
+
+func (c *configTLS) certConfig(cert certType, files map[string]time.Time) (*tls.Config, error) {
+	caFile, certFile, keyFile := c.CAFile, c.CertFile, c.KeyFile
+	if caFile == "" {
+		caFile = cert.root
+	}
+	if certFile == "" {
+		certFile = cert.pem
+	}
+	if keyFile == "" {
+		keyFile = cert.key
+	}
+	for _, f := range []string{caFile, certFile, keyFile} {
+		if f == "" {
+			return nil, errors.New("ca_file, cert_file and key_file are required")
+		}
+		files[f] = modTime(f)
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, issuer, subject := c.ServerName, c.ServerCertIssuer, c.ServerCertSubject
+
+	// Как в Zabbix: цепочка проверяется по CA, имя - только если задано server_name, затем issuer и subject
+	return &tls.Config{
+		Certificates:       []tls.Certificate{keyPair},
+		RootCAs:            roots,
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // Проверка в VerifyConnection
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("proxy sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			opts := x509.VerifyOptions{Roots: roots, DNSName: serverName, Intermediates: x509.NewCertPool()}
+			for _, i := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(i)
+			}
+			if _, err := leaf.Verify(opts); err != nil {
+				return err
+			}
+			if issuer != "" && leaf.Issuer.String() != issuer {
+				return fmt.Errorf("proxy certificate issuer %q doesn't match %q", leaf.Issuer.String(), issuer)
+			}
+			if subject != "" && leaf.Subject.String() != subject {
+				return fmt.Errorf("proxy certificate subject %q doesn't match %q", leaf.Subject.String(), subject)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Идентификатор и ключ PSK (от 32 до 512 hex символов), как в Zabbix
+func (c *configTLS) loadPSK(files map[string]time.Time) ([]byte, error) {
+	if c.PSKIdentity == "" || c.PSKFile == "" {
+		return nil, errors.New("psk_identity and psk_file are required")
+	}
+	if len(c.PSKIdentity) > 128 {
+		return nil, errors.New("psk_identity is longer than 128 bytes")
+	}
+	files[c.PSKFile] = modTime(c.PSKFile)
+
+	b, err := os.ReadFile(c.PSKFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) < 16 || len(key) > 256 {
+		return nil, fmt.Errorf("wrong PSK in %s, need 32 to 512 hex digits", c.PSKFile)
+	}
+
+	return key, nil
+}
+
+// Время изменения файла, отсутствующий - нулевое: перечитка при появлении
+func modTime(file string) time.Time {
+	if fst, err := os.Stat(file); err == nil {
+		return fst.ModTime()
+	}
+	return time.Time{}
+}
+
+// Подключение к прокси с TLS по его параметрам. Ошибки TLS возвращаются как ошибки подключения.
+// deadline действует на подключение, TLS и весь последующий обмен
+func dialProxy(proxyName string, addr net.TCPAddr, deadline time.Time) (net.Conn, error) {
+	s := proxyTLS.get(proxyName)
+	if s.err != nil {
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: &addr, Err: s.err}
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial(addr.Network(), addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch s.connect {
+	case tlsUnencrypted:
+		return conn, nil
+	case tlsPSK:
+		pskConn, err := pskClient(conn, s.pskIdentity, s.pskKey)
+		if err != nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: &addr, Err: err}
+		}
+		return pskConn, nil
+	}
+
+	tlsConn := tls.Client(conn, s.config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: addr.Network(), Addr: &addr, Err: err}
+	}
+
+	return tlsConn, nil
+}
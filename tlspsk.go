@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+)
+
+// Клиент TLS 1.2 с PSK (RFC 4279, RFC 5487), т.к. в crypto/tls нет наборов шифров TLS-PSK.
+// Набор шифров TLS_PSK_WITH_AES_128_GCM_SHA256 есть в списках по умолчанию Zabbix с OpenSSL и GnuTLS
+
+const (
+	pskCipherSuite = 0x00a8 // TLS_PSK_WITH_AES_128_GCM_SHA256
+	pskSCSV        = 0x00ff // TLS_EMPTY_RENEGOTIATION_INFO_SCSV
+	pskVersion     = 0x0303 // TLS 1.2
+
+	pskRecordChangeCipherSpec = 20
+	pskRecordAlert            = 21
+	pskRecordHandshake        = 22
+	pskRecordApplicationData  = 23
+
+	pskClientHello       = 1
+	pskServerHello       = 2
+	pskServerKeyExchange = 12
+	pskServerHelloDone   = 14
+	pskClientKeyExchange = 16
+	pskFinished          = 20
+
+	pskMaxPlaintext  = 16384
+	pskMaxCiphertext = pskMaxPlaintext + 2048
+	pskMaxHandshake  = 65536
+	pskKeyLen        = 16 // AES-128
+	pskIVLen         = 4  // Неявная часть nonce GCM
+	pskNonceLen      = 8  // Явная часть nonce в записи
+	pskVerifyLen     = 12
+)
+
+var (
+	errPSKHandshake = errors.New("TLS PSK: unexpected handshake message")
+)
+
+// Названия частых предупреждений сервера для лога
+var pskAlerts = map[byte]string{
+	10:  "unexpected message",
+	20:  "bad record mac",
+	40:  "handshake failure",
+	47:  "illegal parameter",
+	51:  "decrypt error",
+	70:  "protocol version",
+	80:  "internal error",
+	115: "unknown PSK identity",
+}
+
+// Шифрование записей в одном направлении
+type pskCipher struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+type pskConn struct {
+	net.Conn
+	identity string
+	key      []byte
+
+	transcript hash.Hash // Хэш сообщений рукопожатия для Finished
+	hs         []byte    // Непрочитанные данные рукопожатия
+	in, out    *pskCipher
+	data       []byte // Расшифрованные и ещё не прочитанные данные
+	err        error  // Ошибка чтения, повторяется при следующих вызовах
+}
+
+// Рукопожатие TLS-PSK на открытом соединении
+func pskClient(conn net.Conn, identity string, key []byte) (net.Conn, error) {
+	c := &pskConn{Conn: conn, identity: identity, key: key, transcript: sha256.New()}
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pskConn) handshake() error {
+	clientRandom := make([]byte, 32)
+	if _, err := rand.Read(clientRandom); err != nil {
+		return err
+	}
+
+	hello := []byte{pskVersion >> 8, pskVersion & 0xff}
+	hello = append(hello, clientRandom...)
+	hello = append(hello, 0)    // Без session id
+	hello = append(hello, 0, 4) // Наборы шифров
+	hello = append(hello, pskCipherSuite>>8, pskCipherSuite&0xff, pskSCSV>>8, pskSCSV&0xff)
+	hello = append(hello, 1, 0) // Без сжатия
+	if err := c.writeHandshake(pskClientHello, hello); err != nil {
+		return err
+	}
+
+	typ, body, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	if typ != pskServerHello {
+		return errPSKHandshake
+	}
+	serverRandom, err := pskParseServerHello(body)
+	if err != nil {
+		return err
+	}
+
+	for done := false; !done; { // Подсказка идентификатора в ServerKeyExchange не используется
+		typ, _, err := c.readHandshake()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case pskServerKeyExchange:
+		case pskServerHelloDone:
+			done = true
+		default:
+			return errPSKHandshake
+		}
+	}
+
+	kx := make([]byte, 2, 2+len(c.identity))
+	binary.BigEndian.PutUint16(kx, uint16(len(c.identity)))
+	kx = append(kx, c.identity...)
+	if err := c.writeHandshake(pskClientKeyExchange, kx); err != nil {
+		return err
+	}
+
+	// Предварительный секрет PSK: длина, нули той же длины, длина, ключ
+	n := len(c.key)
+	premaster := make([]byte, 2+n+2, 4+2*n)
+	binary.BigEndian.PutUint16(premaster, uint16(n))
+	binary.BigEndian.PutUint16(premaster[2+n:], uint16(n))
+	premaster = append(premaster, c.key...)
+
+	master := pskPRF(premaster, "master secret", concat(clientRandom, serverRandom), 48)
+	keys := pskPRF(master, "key expansion", concat(serverRandom, clientRandom), 2*pskKeyLen+2*pskIVLen)
+	clientKey, serverKey := keys[:pskKeyLen], keys[pskKeyLen:2*pskKeyLen]
+	clientIV, serverIV := keys[2*pskKeyLen:2*pskKeyLen+pskIVLen], keys[2*pskKeyLen+pskIVLen:]
+
+	if err := c.writeRecord(pskRecordChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	if c.out, err = newPSKCipher(clientKey, clientIV); err != nil {
+		return err
+	}
+	if err := c.writeHandshake(pskFinished, pskPRF(master, "client finished", c.transcript.Sum(nil), pskVerifyLen)); err != nil {
+		return err
+	}
+	expected := pskPRF(master, "server finished", c.transcript.Sum(nil), pskVerifyLen)
+
+	typ, payload, err := c.readRecord()
+	if err != nil {
+		return err
+	}
+	if typ != pskRecordChangeCipherSpec || len(payload) != 1 || len(c.hs) != 0 {
+		return errPSKHandshake
+	}
+	if c.in, err = newPSKCipher(serverKey, serverIV); err != nil {
+		return err
+	}
+
+	typ, body, err = c.readHandshake()
+	if err != nil {
+		return err
+	}
+	if typ != pskFinished || !hmac.Equal(body, expected) {
+		return errors.New("TLS PSK: wrong server Finished, PSK doesn't match")
+	}
+
+	return nil
+}
+
+// Случайное число сервера, выбранные версия и набор шифров
+func pskParseServerHello(b []byte) ([]byte, error) {
+	if len(b) < 2+32+1 {
+		return nil, errPSKHandshake
+	}
+	if v := binary.BigEndian.Uint16(b); v != pskVersion {
+		return nil, fmt.Errorf("TLS PSK: server chose version %#04x", v)
+	}
+	random := b[2:34]
+	sid := int(b[34])
+	if len(b) < 35+sid+3 {
+		return nil, errPSKHandshake
+	}
+	if suite := binary.BigEndian.Uint16(b[35+sid:]); suite != pskCipherSuite {
+		return nil, fmt.Errorf("TLS PSK: server chose cipher suite %#04x", suite)
+	}
+	if b[35+sid+2] != 0 {
+		return nil, errPSKHandshake
+	}
+	return random, nil
+}
+
+func newPSKCipher(key, iv []byte) (*pskCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pskCipher{aead: aead, iv: iv}, nil
+}
+
+// Номер записи, тип, версия и длина открытых данных
+func (p *pskCipher) additional(typ byte, n int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, p.seq)
+	ad[8] = typ
+	binary.BigEndian.PutUint16(ad[9:], pskVersion)
+	binary.BigEndian.PutUint16(ad[11:], uint16(n))
+	return ad
+}
+
+// Явная часть nonce - номер записи
+func (p *pskCipher) seal(typ byte, data []byte) []byte {
+	nonce := make([]byte, pskIVLen+pskNonceLen)
+	copy(nonce, p.iv)
+	binary.BigEndian.PutUint64(nonce[pskIVLen:], p.seq)
+
+	out := p.aead.Seal(append([]byte{}, nonce[pskIVLen:]...), nonce, data, p.additional(typ, len(data)))
+	p.seq++
+	return out
+}
+
+func (p *pskCipher) open(typ byte, data []byte) ([]byte, error) {
+	if len(data) < pskNonceLen+p.aead.Overhead() {
+		return nil, errors.New("TLS PSK: short record")
+	}
+	nonce := make([]byte, pskIVLen+pskNonceLen)
+	copy(nonce, p.iv)
+	copy(nonce[pskIVLen:], data[:pskNonceLen])
+
+	plain, err := p.aead.Open(nil, nonce, data[pskNonceLen:], p.additional(typ, len(data)-pskNonceLen-p.aead.Overhead()))
+	if err != nil {
+		return nil, errors.New("TLS PSK: bad record mac")
+	}
+	p.seq++
+	return plain, nil
+}
+
+func (c *pskConn) writeRecord(typ byte, data []byte) error {
+	if c.out != nil {
+		data = c.out.seal(typ, data)
+	}
+	b := make([]byte, 5, 5+len(data))
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[1:], pskVersion)
+	binary.BigEndian.PutUint16(b[3:], uint16(len(data)))
+	_, err := c.Conn.Write(append(b, data...))
+	return err
+}
+
+func (c *pskConn) writeHandshake(typ byte, body []byte) error {
+	msg := []byte{typ, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+	c.transcript.Write(msg)
+	return c.writeRecord(pskRecordHandshake, msg)
+}
+
+// Запись от сервера, после ChangeCipherSpec - расшифрованная. Предупреждение сервера - ошибка
+func (c *pskConn) readRecord() (byte, []byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(c.Conn, head); err != nil {
+		return 0, nil, err
+	}
+	typ := head[0]
+	n := int(binary.BigEndian.Uint16(head[3:]))
+	if head[1] != 3 || n > pskMaxCiphertext {
+		return 0, nil, errors.New("TLS PSK: wrong record header")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return 0, nil, err
+	}
+	if c.in != nil && typ != pskRecordChangeCipherSpec {
+		var err error
+		if data, err = c.in.open(typ, data); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if typ == pskRecordAlert {
+		if len(data) != 2 {
+			return 0, nil, errors.New("TLS PSK: wrong alert")
+		}
+		if data[1] == 0 { // close_notify
+			return 0, nil, io.EOF
+		}
+		desc, have := pskAlerts[data[1]]
+		if !have {
+			desc = fmt.Sprintf("alert %d", data[1])
+		}
+		return 0, nil, fmt.Errorf("TLS PSK: remote error: %s", desc)
+	}
+
+	return typ, data, nil
+}
+
+// Очередное сообщение рукопожатия, может занимать несколько записей
+func (c *pskConn) readHandshake() (byte, []byte, error) {
+	for {
+		if len(c.hs) >= 4 {
+			n := int(c.hs[1])<<16 | int(c.hs[2])<<8 | int(c.hs[3])
+			if n > pskMaxHandshake {
+				return 0, nil, errors.New("TLS PSK: handshake message too large")
+			}
+			if len(c.hs) >= 4+n {
+				msg := c.hs[:4+n]
+				c.hs = c.hs[4+n:]
+				c.transcript.Write(msg)
+				return msg[0], msg[4:], nil
+			}
+		}
+
+		typ, data, err := c.readRecord()
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != pskRecordHandshake {
+			return 0, nil, errPSKHandshake
+		}
+		c.hs = append(c.hs, data...)
+	}
+}
+
+func (c *pskConn) Read(b []byte) (int, error) {
+	for len(c.data) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		typ, data, err := c.readRecord()
+		switch {
+		case err != nil:
+			c.err = err
+		case typ == pskRecordApplicationData:
+			c.data = data
+		default: // Повторное рукопожатие не поддерживается
+			c.err = errPSKHandshake
+		}
+	}
+
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *pskConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > pskMaxPlaintext {
+			n = pskMaxPlaintext
+		}
+		if err := c.writeRecord(pskRecordApplicationData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *pskConn) Close() error {
+	_ = c.writeRecord(pskRecordAlert, []byte{1, 0}) // close_notify
+	return c.Conn.Close()
+}
+
+// PRF TLS 1.2 с SHA-256 (RFC 5246, раздел 5)
+func pskPRF(secret []byte, label string, seed []byte, n int) []byte {
+	seed = concat([]byte(label), seed)
+	mac := hmac.New(sha256.New, secret)
+
+	result := make([]byte, 0, n+sha256.Size)
+	a := seed
+	for len(result) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		result = mac.Sum(result)
+	}
+
+	return result[:n]
+}
+
+func concat(a, b []byte) []byte {
+	return append(append(make([]byte, 0, len(a)+len(b)), a...), b...)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPSKIdentity = "zabbixtrapd"
+
+var testPSKKey = []byte{
+	0x1f, 0x87, 0xb5, 0x05, 0x05, 0xfd, 0xa4, 0x5c, 0xa8, 0x5f, 0x2d, 0xe1, 0x8d, 0x34, 0x44, 0xd7,
+	0x4c, 0x12, 0x8b, 0x4e, 0x99, 0xa9, 0x00, 0x3d, 0x5e, 0xa5, 0x6d, 0x91, 0x58, 0x5a, 0x06, 0xee,
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Тестовый вектор PRF TLS 1.2 с SHA-256 (IETF TLS WG), совпадает с openssl kdf TLS1-PRF
+func TestPSKPRF(t *testing.T) {
+	secret := mustHex(t, "9bbe436ba940f017b17652849a71db35")
+	seed := mustHex(t, "a0ba9f936cda311827a6f796ffd5198c")
+	want := mustHex(t, "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a"+
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab"+
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701"+
+		"87347b66")
+
+	if got := pskPRF(secret, "test label", seed, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("PRF = %x\nwant %x", got, want)
+	}
+	if got := pskPRF(secret, "test label", seed, 12); !bytes.Equal(got, want[:12]) {
+		t.Fatalf("short PRF = %x, want %x", got, want[:12])
+	}
+}
+
+// Изменённая запись, чужой номер записи или тип не расшифровываются
+func TestPSKCipher(t *testing.T) {
+	key := make([]byte, pskKeyLen)
+	iv := []byte{1, 2, 3, 4}
+
+	newPair := func() (*pskCipher, *pskCipher) {
+		out, err := newPSKCipher(key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, _ := newPSKCipher(key, iv)
+		return out, in
+	}
+
+	out, in := newPair()
+	for _, msg := range []string{"first", "second"} {
+		plain, err := in.open(pskRecordApplicationData, out.seal(pskRecordApplicationData, []byte(msg)))
+		if err != nil || string(plain) != msg {
+			t.Fatalf("open = %q, %v, want %q", plain, err, msg)
+		}
+	}
+
+	out, in = newPair()
+	record := out.seal(pskRecordApplicationData, []byte("data"))
+	record[len(record)-1] ^= 1
+	if _, err := in.open(pskRecordApplicationData, record); err == nil {
+		t.Error("tampered record accepted")
+	}
+
+	out, in = newPair()
+	out.seal(pskRecordApplicationData, []byte("lost"))
+	if _, err := in.open(pskRecordApplicationData, out.seal(pskRecordApplicationData, []byte("data"))); err == nil {
+		t.Error("record with wrong sequence number accepted")
+	}
+
+	out, in = newPair()
+	if _, err := in.open(pskRecordHandshake, out.seal(pskRecordApplicationData, []byte("data"))); err == nil {
+		t.Error("record with wrong type accepted")
+	}
+
+	if _, err := in.open(pskRecordApplicationData, make([]byte, pskNonceLen)); err == nil {
+		t.Error("short record accepted")
+	}
+}
+
+// Сервер на другом конце net.Pipe: читает ClientHello и отвечает заданными байтами
+func pskFakeServer(reply []byte) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(server, head); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(server, make([]byte, int(head[3])<<8|int(head[4]))); err != nil {
+			return
+		}
+		_, _ = server.Write(reply)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func pskRecord(typ byte, data []byte) []byte {
+	return append([]byte{typ, 3, 3, byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func pskServerHelloRecord(suite uint16) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0, byte(suite>>8), byte(suite), 0)
+	return pskRecord(pskRecordHandshake, append([]byte{pskServerHello, 0, 0, byte(len(body))}, body...))
+}
+
+func TestPSKClientErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []byte
+		want  string // Часть текста ошибки, пустая - io.ErrUnexpectedEOF
+	}{
+		{"alert", pskRecord(pskRecordAlert, []byte{2, 115}), "unknown PSK identity"},
+		{"unknown alert", pskRecord(pskRecordAlert, []byte{2, 99}), "alert 99"},
+		{"close notify", pskRecord(pskRecordAlert, []byte{1, 0}), "EOF"},
+		{"truncated record", pskRecord(pskRecordHandshake, make([]byte, 40))[:20], ""},
+		{"truncated header", []byte{pskRecordHandshake, 3, 3}, ""},
+		{"oversized record", []byte{pskRecordHandshake, 3, 3, 0xff, 0xff}, "wrong record header"},
+		{"not TLS", []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), "wrong record header"},
+		{"wrong cipher suite", pskServerHelloRecord(0x002f), "cipher suite 0x002f"},
+		{"unexpected message", pskRecord(pskRecordHandshake, []byte{pskFinished, 0, 0, 0}), errPSKHandshake.Error()},
+		{"application data", pskRecord(pskRecordApplicationData, []byte("data")), errPSKHandshake.Error()},
+	}
+
+	for _, tt := range tests {
+		conn := pskFakeServer(tt.reply)
+		_, err := pskClient(conn, testPSKIdentity, testPSKKey)
+		conn.Close()
+
+		switch {
+		case err == nil:
+			t.Errorf("%s: handshake succeeded", tt.name)
+		case tt.want == "" && !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Errorf("%s: error %v, want %v", tt.name, err, io.ErrUnexpectedEOF)
+		case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Рукопожатие и обмен данными с эталонной реализацией: openssl s_server отвечает строкой задом наперёд
+func TestPSKClientOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found")
+	}
+	if testing.Short() {
+		t.Skip("short mode")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command("openssl", "s_server", "-accept", addr[strings.LastIndexByte(addr, ':')+1:],
+		"-psk", hex.EncodeToString(testPSKKey), "-psk_identity", testPSKIdentity, "-nocert",
+		"-cipher", "PSK-AES128-GCM-SHA256", "-tls1_2", "-rev", "-naccept", "2", "-quiet")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	dial := func() net.Conn {
+		for i := 0; i < 50; i++ {
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				return conn
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal("openssl s_server didn't start")
+		return nil
+	}
+
+	conn, err := pskClient(dial(), testPSKIdentity, testPSKKey)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ { // Несколько записей в каждую сторону: номера записей и nonce
+		msg := "zabbix sender data " + strconv.Itoa(i)
+		if _, err := conn.Write([]byte(msg + "\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		rev := []byte(msg)
+		for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+			rev[i], rev[j] = rev[j], rev[i]
+		}
+		if strings.TrimRight(line, "\n") != string(rev) {
+			t.Fatalf("reply %q, want %q", line, rev)
+		}
+	}
+	conn.Close()
+
+	wrong := append([]byte{}, testPSKKey...)
+	wrong[0] ^= 1
+	if _, err := pskClient(dial(), testPSKIdentity, wrong); err == nil {
+		t.Error("handshake with wrong key succeeded")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+// Локализация ключа из пароля - около мегабайта хэширования, до проверки подписи. Для engineID, которых
+// нет в cred.json, среди выученных и не наш, она ограничена, чтобы поддельные трапы не занимали процессор
+const (
+	usmLocalizeRate  = 10 // В секунду
+	usmLocalizeBurst = 20
+)
+
+var (
+	usmUsers usmUsersType
+
+	errBER         = errors.New("malformed BER")
+	errUSMLocalize = errors.New("key localization limit for unknown engine IDs exceeded")
+)
+
+// Пользователь SNMPv3 (USM)
+type usmUserType struct {
+	msgFlags     snmp.SnmpV3MsgFlags
+	authProtocol snmp.SnmpV3AuthProtocol
+	authPassword string
+	privProtocol snmp.SnmpV3PrivProtocol
+	privPassword string
+}
+
+type usmUsersType struct {
+	u        map[string]usmUserType
+	params   map[string]*snmp.GoSNMP // Кэш параметров с локализованными под engineID ключами. Ключ: user + engineID
+	localize bucketType              // Локализации для незнакомых engineID
+
+	sync.RWMutex
+}
+
+func init() {
+	usmUsers.u = make(map[string]usmUserType)
+	usmUsers.params = make(map[string]*snmp.GoSNMP)
+}
+
+// Перезагрузка таблицы пользователей из cred.json
+func (u *usmUsersType) load(users []configUSMUser) {
+	uu := make(map[string]usmUserType)
+
+	for _, i := range users {
+		if i.User == "" {
+			continue
+		}
+		user, err := i.usmUser()
+		if err != nil {
+			log.Printf("USM: user %s skipped: %v\n", i.User, err)
+			continue
+		}
+		uu[i.User] = user
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.u = uu
+	u.params = make(map[string]*snmp.GoSNMP) // Пароли могли измениться - ключи локализуем заново
+}
+
+func (c configUSMUser) usmUser() (user usmUserType, err error) {
+	user.authProtocol, err = authProtocol(c.AuthProtocol)
+	if err != nil {
+		return
+	}
+	user.privProtocol, err = privProtocol(c.PrivProtocol)
+	if err != nil {
+		return
+	}
+	user.authPassword = c.AuthPassword
+	user.privPassword = c.PrivPassword
+
+	switch {
+	case user.privProtocol != snmp.NoPriv && user.authProtocol == snmp.NoAuth:
+		err = fmt.Errorf("privacy protocol %s requires authentication", c.PrivProtocol)
+	case user.privProtocol != snmp.NoPriv:
+		user.msgFlags = snmp.AuthPriv
+	case user.authProtocol != snmp.NoAuth:
+		user.msgFlags = snmp.AuthNoPriv
+	default:
+		user.msgFlags = snmp.NoAuthNoPriv
+	}
+
+	return
+}
+
+// Параметры разбора трапа для пользователя и engineID отправителя
+func (u *usmUsersType) get(userName, engineID string) (*snmp.GoSNMP, usmUserType, error) {
+	u.RLock()
+	user, have := u.u[userName]
+	params, cached := u.params[userName+"\x00"+engineID]
+	u.RUnlock()
+
+	if !have {
+		return nil, user, fmt.Errorf("unknown USM user %q", userName)
+	}
+	if cached {
+		return params, user, nil
+	}
+
+	known := engines.known(engineID)
+	if !known && user.msgFlags != snmp.NoAuthNoPriv {
+		u.Lock()
+		allow := u.localize.take(time.Now(), usmLocalizeRate, usmLocalizeBurst)
+		u.Unlock()
+		if !allow {
+			return nil, user, errUSMLocalize
+		}
+	}
+
+	params = &snmp.GoSNMP{
+		Version:       snmp.Version3,
+		SecurityModel: snmp.UserSecurityModel,
+		MsgFlags:      user.msgFlags,
+		SecurityParameters: &snmp.UsmSecurityParameters{
+			UserName:                 userName,
+			AuthoritativeEngineID:    engineID,
+			AuthenticationProtocol:   user.authProtocol,
+			AuthenticationPassphrase: user.authPassword,
+			PrivacyProtocol:          user.privProtocol,
+			PrivacyPassphrase:        user.privPassword,
+			Logger:                   snmp.NewLogger(log.Default()),
+		},
+	}
+	if known { // Набор известных engineID ограничен: ключи кэшируются до проверки подписи
+		u.keep(userName, engineID, params)
+	}
+
+	return params, user, nil
+}
+
+// Сохраняем параметры в кэше. Для незнакомых engineID - только после успешной проверки подписи,
+// чтобы не копить ключи для подделанных engineID
+func (u *usmUsersType) keep(userName, engineID string, params *snmp.GoSNMP) {
+	u.Lock()
+	defer u.Unlock()
+
+	if _, have := u.u[userName]; have {
+		u.params[userName+"\x00"+engineID] = params
+	}
+}
+
+func authProtocol(s string) (snmp.SnmpV3AuthProtocol, error) {
+	switch strings.ReplaceAll(strings.ToUpper(s), "-", "") {
+	case "", "NOAUTH":
+		return snmp.NoAuth, nil
+	case "MD5":
+		return snmp.MD5, nil
+	case "SHA", "SHA1":
+		return snmp.SHA, nil
+	case "SHA224":
+		return snmp.SHA224, nil
+	case "SHA256":
+		return snmp.SHA256, nil
+	case "SHA384":
+		return snmp.SHA384, nil
+	case "SHA512":
+		return snmp.SHA512, nil
+	}
+	return snmp.NoAuth, fmt.Errorf("unknown auth protocol %q", s)
+}
+
+func privProtocol(s string) (snmp.SnmpV3PrivProtocol, error) {
+	switch strings.ReplaceAll(strings.ToUpper(s), "-", "") {
+	case "", "NOPRIV":
+		return snmp.NoPriv, nil
+	case "DES":
+		return snmp.DES, nil
+	case "AES", "AES128":
+		return snmp.AES, nil
+	case "AES192":
+		return snmp.AES192, nil
+	case "AES256":
+		return snmp.AES256, nil
+	case "AES192C":
+		return snmp.AES192C, nil
+	case "AES256C":
+		return snmp.AES256C, nil
+	}
+	return snmp.NoPriv, fmt.Errorf("unknown privacy protocol %q", s)
+}
+
+// Разбор одного элемента BER: тег, содержимое и остаток буфера
+func berNext(b []byte) (tag byte, value []byte, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBER
+	}
+
+	tag = b[0]
+	l := int(b[1])
+	i := 2
+	if l&0x80 != 0 { // Длинная форма длины
+		n := l & 0x7f
+		if n == 0 || n > 4 || len(b) < i+n {
+			return 0, nil, nil, errBER
+		}
+		l = 0
+		for _, c := range b[i : i+n] {
+			l = l<<8 | int(c)
+		}
+		i += n
+	}
+	if l < 0 || len(b)-i < l {
+		return 0, nil, nil, errBER
+	}
+
+	return tag, b[i : i+l], b[i+l:], nil
+}
+
+// Версия SNMP сообщения без полного разбора
+func snmpVersion(msg []byte) (snmp.SnmpVersion, error) {
+	tag, v, _, err := berNext(msg)
+	if err != nil || tag != byte(snmp.Sequence) {
+		return 0, errBER
+	}
+	tag, v, _, err = berNext(v)
+	if err != nil || tag != byte(snmp.Integer) || len(v) != 1 {
+		return 0, errBER
+	}
+
+	return snmp.SnmpVersion(v[0]), nil
+}
+
+// engineID и имя пользователя из заголовка SNMPv3 до проверки подписи
+func usmPeek(msg []byte) (engineID, userName string, err error) {
+	var tag byte
+	var v, sp []byte
+
+	if _, v, _, err = berNext(msg); err != nil { // Message
+		return
+	}
+	for i := 0; i < 2; i++ { // msgVersion, msgGlobalData
+		if _, _, v, err = berNext(v); err != nil {
+			return
+		}
+	}
+	if tag, sp, _, err = berNext(v); err != nil || tag != byte(snmp.OctetString) { // msgSecurityParameters
+		return "", "", errBER
+	}
+	if _, sp, _, err = berNext(sp); err != nil { // UsmSecurityParameters
+		return
+	}
+
+	var eid, user []byte
+
+	if _, eid, sp, err = berNext(sp); err != nil {
+		return
+	}
+	for i := 0; i < 2; i++ { // msgAuthoritativeEngineBoots, msgAuthoritativeEngineTime
+		if _, _, sp, err = berNext(sp); err != nil {
+			return
+		}
+	}
+	if _, user, _, err = berNext(sp); err != nil {
+		return
+	}
+
+	return string(eid), string(user), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+const (
+	quarantineSize   = 100   // Количество последних отброшенных трапов для разбора
+	malformedSources = 10000 // Ограничение количества источников в статистике
+	malformedOther   = "other"
+
+	reasonPDUType       = "unexpected_pdu_type"
+	reasonShortPDU      = "short_pdu"
+	reasonNoTrapOid     = "no_trap_oid"
+	reasonTrapOidType   = "bad_trap_oid_type"
+	reasonValueType     = "bad_value_type"
+	reasonEmptyVariable = "empty_variable_name"
+	reasonMalformed     = "malformed" // Сообщение не разобрано: ошибка BER, SNMPv3 USM или engineID
+)
+
+var (
+	quarantine quarantineType
+)
+
+// Отброшенный при проверке трап
+type quarantineItem struct {
+	Time    time.Time          `json:"time"`
+	Source  string             `json:"source"`
+	Reason  string             `json:"reason"`
+	Detail  string             `json:"detail"`
+	Raw     []byte             `json:"raw"`               // base64
+	Decoded *quarantineDecoded `json:"decoded,omitempty"` // Нет для неразобранных сообщений
+}
+
+type quarantineDecoded struct {
+	Version   string              `json:"version"`
+	PDUType   string              `json:"pdu_type"`
+	RequestID uint32              `json:"request_id"`
+	Variables []quarantineVarbind `json:"variables"`
+}
+
+type quarantineVarbind struct {
+	Oid   string `json:"oid"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type quarantineType struct {
+	q    []quarantineItem
+	next int
+
+	sync.RWMutex
+}
+
+func init() {
+	quarantine.q = make([]quarantineItem, 0, quarantineSize)
+}
+
+// Проверка трапа перед фильтрацией. Возвращает код причины и описание, если трап не может быть обработан
+func validateTrap(packet snmp.SnmpPacket) (reason string, detail string) {
+	switch packet.PDUType {
+	case snmp.SNMPv2Trap, snmp.InformRequest, snmp.Trap:
+	default:
+		return reasonPDUType, fmt.Sprintf("0x%x", byte(packet.PDUType))
+	}
+
+	if len(packet.Variables) < 2 {
+		return reasonShortPDU, fmt.Sprintf("%d variables", len(packet.Variables))
+	}
+
+	if packet.Variables[1].Name != oidSnmpTrapOID {
+		return reasonNoTrapOid, "variable [1] is " + packet.Variables[1].Name
+	}
+
+	if _, ok := packet.Variables[1].Value.(string); !ok || packet.Variables[1].Type != snmp.ObjectIdentifier {
+		return reasonTrapOidType, packet.Variables[1].Type.String()
+	}
+
+	for i, v := range packet.Variables {
+		if v.Name == "" {
+			return reasonEmptyVariable, fmt.Sprintf("variable [%d]", i)
+		}
+		if v.Type == snmp.OctetString {
+			if _, ok := v.Value.([]byte); !ok {
+				return reasonValueType, fmt.Sprintf("variable %s: OctetString value %T", v.Name, v.Value)
+			}
+		}
+	}
+
+	return "", ""
+}
+
+func (q *quarantineType) add(trap trapRaw, reason, detail string) {
+	item := quarantineItem{
+		Time:   trap.time,
+		Source: trap.addr.IP.String(),
+		Reason: reason,
+		Detail: detail,
+		Raw:    trap.raw,
+		Decoded: &quarantineDecoded{
+			Version:   trap.packet.Version.String(),
+			PDUType:   fmt.Sprintf("0x%x", byte(trap.packet.PDUType)),
+			RequestID: trap.packet.RequestID,
+		},
+	}
+	for _, v := range trap.packet.Variables {
+		item.Decoded.Variables = append(item.Decoded.Variables, quarantineVarbind{
+			Oid:   v.Name,
+			Type:  v.Type.String(),
+			Value: fmt.Sprintf("%v", v.Value),
+		})
+	}
+
+	q.push(item)
+}
+
+// Сообщение, которое не удалось разобрать
+func (q *quarantineType) addMalformed(msg []byte, addr net.UDPAddr, err error) {
+	q.push(quarantineItem{
+		Time:   time.Now(),
+		Source: addr.IP.String(),
+		Reason: reasonMalformed,
+		Detail: err.Error(),
+		Raw:    msg,
+	})
+}
+
+func (q *quarantineType) push(item quarantineItem) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.q) < quarantineSize {
+		q.q = append(q.q, item)
+	} else {
+		q.q[q.next] = item
+	}
+	q.next = (q.next + 1) % quarantineSize
+}
+
+// Содержимое карантина от старых к новым
+func (q *quarantineType) list() []quarantineItem {
+	q.RLock()
+	defer q.RUnlock()
+
+	result := make([]quarantineItem, 0, len(q.q))
+	if len(q.q) == quarantineSize {
+		result = append(result, q.q[q.next:]...)
+		result = append(result, q.q[:q.next]...)
+	} else {
+		result = append(result, q.q...)
+	}
+
+	return result
+}
+
+func quarantineList(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(quarantine.list())
+}
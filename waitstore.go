@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	snmp "github.com/gosnmp/gosnmp"
+)
+
+const (
+	waitSnapshotInterval = 60 * time.Second // Период записи снимка очереди трапов "потери"
+	waitLogMax           = 1000             // Записей в журнале до внеочередного снимка
+	waitOpSet            = "set"
+	waitOpDel            = "del"
+)
+
+var (
+	waitStore waitStoreType
+)
+
+// Состояние очереди трапов "потери" на диске: снимок (файл --waitqueue) и журнал изменений после него (.log)
+type waitStoreType struct {
+	log          *os.File
+	w            *bufio.Writer
+	pending      map[string]waitPending // Изменения до записи журнала, по ключу трапа - последнее
+	logged       int                    // Записей в журнале после снимка
+	lastSnapshot time.Time
+	stat         waitStoreStat
+	fileMu       sync.Mutex // Запись журнала и снимка: из trapLost и при остановке. Берётся до Mutex
+
+	sync.Mutex
+}
+
+// Изменение очереди, ещё не записанное в журнал
+type waitPending struct {
+	op   string
+	trap trapConverted
+}
+
+// Восстановленная очередь в /status
+type waitStoreStat struct {
+	Entries      int       `json:"entries"`
+	Restored     int       `json:"restored"`
+	Expired      int       `json:"expired"` // Истекли во время простоя, отправлены сразу
+	RestoredAt   time.Time `json:"restored_at,omitempty"`
+	LastSnapshot time.Time `json:"last_snapshot,omitempty"`
+	Logged       int       `json:"logged"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Ожидающий трап на диске
+type waitEntry struct {
+	Expire    time.Time `json:"expire"`
+	IP        string    `json:"ip"`
+	Port      int       `json:"port,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	Name      string    `json:"name"`
+	LastDigit string    `json:"value"`
+	Oid       string    `json:"oid"`
+	IfIndex   string    `json:"ifindex,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	Index     []string  `json:"index,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Vars      []waitVar `json:"vars,omitempty"`
+}
+
+type waitVar struct {
+	Oid   string `json:"oid"`
+	Name  string `json:"name,omitempty"`
+	Index string `json:"index,omitempty"`
+	Value string `json:"value"`
+	Raw   string `json:"raw,omitempty"`
+	Type  byte   `json:"type"`
+}
+
+// Запись журнала: set - добавление или обновление, del - удаление
+type waitLogRecord struct {
+	Op    string    `json:"op"`
+	Entry waitEntry `json:"entry"`
+}
+
+func newWaitEntry(trap trapConverted) waitEntry {
+	e := waitEntry{
+		Expire:    trap.time,
+		IP:        trap.addr.IP.String(),
+		Port:      trap.addr.Port,
+		Transport: trap.transport,
+		Name:      trap.name,
+		LastDigit: trap.lastDigit,
+		Oid:       trap.oid,
+		IfIndex:   trap.ifIndex,
+		Count:     trap.count,
+		Index:     trap.index,
+		Host:      trap.host,
+	}
+	for _, p := range trap.packet {
+		e.Vars = append(e.Vars, waitVar{Oid: p.oid, Name: p.name, Index: p.index, Value: p.value, Raw: p.raw, Type: byte(p.asn1BER)})
+	}
+	return e
+}
+
+// Трап из записи на диске. Ключ и формат значения - из текущего traps.txt
+func (e waitEntry) trap() trapConverted {
+	trap := trapConverted{
+		time:      e.Expire,
+		addr:      net.UDPAddr{IP: net.ParseIP(e.IP), Port: e.Port},
+		transport: e.Transport,
+		name:      e.Name,
+		lastDigit: e.LastDigit,
+		oid:       e.Oid,
+		ifIndex:   e.IfIndex,
+		count:     e.Count,
+		index:     e.Index,
+		host:      e.Host,
+	}
+	for _, v := range e.Vars {
+		trap.packet = append(trap.packet, snmpPacket{oid: v.Oid, name: v.Name, index: v.Index, value: v.Value, raw: v.Raw, asn1BER: snmp.Asn1BER(v.Type)})
+	}
+
+	cfg := trapOids.get(e.Oid)
+	trap.key = cfg.key
+	trap.payload = cfg.payload
+
+	return trap
+}
+
+func (e waitEntry) key() string {
+	return waitKey(e.IP, e.Name, e.Index)
+}
+
+func (s *waitStoreType) set(trap trapConverted) {
+	s.append(waitOpSet, trap)
+}
+
+func (s *waitStoreType) del(trap trapConverted) {
+	s.append(waitOpDel, trap)
+}
+
+// Изменение очереди запоминается до записи журнала на следующем тике trapLost. Вызывается под блокировкой
+// очереди, поэтому без обращения к диску: повторы трапа с одним ключом сливаются в одну запись
+func (s *waitStoreType) append(op string, trap trapConverted) {
+	if fileWaitQueue == "" {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending == nil {
+		s.pending = make(map[string]waitPending)
+	}
+	s.pending[trap.waitKey()] = waitPending{op: op, trap: trap}
+}
+
+// Запись накопленных изменений в журнал. Вызывается из trapLost раз в секунду, без блокировки очереди
+func (s *waitStoreType) flush() {
+	if fileWaitQueue == "" {
+		return
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	s.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	var msg string
+	var err error
+	if s.log == nil {
+		if s.log, err = os.OpenFile(fileWaitQueue+".log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			s.log, msg = nil, "WaitQueue: can't open log"
+		} else {
+			s.w = bufio.NewWriter(s.log)
+		}
+	}
+	for _, p := range pending {
+		if s.log == nil {
+			break
+		}
+		var b []byte
+		if b, err = json.Marshal(waitLogRecord{Op: p.op, Entry: newWaitEntry(p.trap)}); err != nil {
+			msg = "WaitQueue: can't Marshal"
+			continue
+		}
+		s.w.Write(append(b, '\n')) // Ошибка записи сохраняется в bufio.Writer и возвращается Flush
+	}
+	if s.log != nil {
+		if ferr := s.w.Flush(); ferr != nil { // Журнал открывается заново, потерянные записи восстановит снимок
+			msg, err = "WaitQueue: can't write log", ferr
+			s.log.Close()
+			s.log, s.w = nil, nil
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.logged += len(pending) // И при ошибке: следующий снимок запишет очередь целиком
+	if msg != "" {
+		s.error(msg, err)
+	}
+}
+
+// Нужен ли снимок: по времени или размеру журнала
+func (s *waitStoreType) due() bool {
+	if fileWaitQueue == "" {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.logged >= waitLogMax || s.logged > 0 && time.Since(s.lastSnapshot) >= waitSnapshotInterval
+}
+
+// Запись снимка очереди и очистка журнала. Вызывается под блокировкой очереди
+func (s *waitStoreType) snapshot(queue []trapConverted) {
+	if fileWaitQueue == "" {
+		return
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = nil // Снимок под блокировкой очереди включает все изменения
+
+	entries := make([]waitEntry, 0, len(queue))
+	for _, trap := range queue {
+		entries = append(entries, newWaitEntry(trap))
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		s.error("WaitQueue: can't Marshal", err)
+		return
+	}
+	if err := os.WriteFile(fileWaitQueue+".tmp", b, 0644); err != nil {
+		s.error("WaitQueue: can't write", err)
+		return
+	}
+	if err := os.Rename(fileWaitQueue+".tmp", fileWaitQueue); err != nil {
+		s.error("WaitQueue: can't rename", err)
+		return
+	}
+
+	if s.log != nil {
+		s.log.Close()
+		s.log, s.w = nil, nil
+	}
+	if err := os.Truncate(fileWaitQueue+".log", 0); err != nil && !os.IsNotExist(err) {
+		s.error("WaitQueue: can't truncate log", err)
+	}
+
+	s.logged = 0
+	s.lastSnapshot = time.Now()
+}
+
+// Чтение снимка и применение журнала
+func (s *waitStoreType) load() []waitEntry {
+	var entries []waitEntry
+
+	b, err := os.ReadFile(fileWaitQueue)
+	if err == nil {
+		if err := json.Unmarshal(b, &entries); err != nil {
+			s.error("WaitQueue: can't Unmarshal "+fileWaitQueue, err)
+			entries = nil
+		}
+	} else if !os.IsNotExist(err) {
+		s.error("WaitQueue: can't read", err)
+	}
+
+	pos := make(map[string]int, len(entries))
+	for i, e := range entries {
+		pos[e.key()] = i
+	}
+
+	f, err := os.Open(fileWaitQueue + ".log")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.error("WaitQueue: can't read log", err)
+		}
+		return entries
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var r waitLogRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil { // Недописанная при остановке запись
+			s.error("WaitQueue: wrong log record", err)
+			continue
+		}
+		key := r.Entry.key()
+		i, have := pos[key]
+		switch {
+		case r.Op == waitOpSet && have:
+			entries[i] = r.Entry
+		case r.Op == waitOpSet:
+			pos[key] = len(entries)
+			entries = append(entries, r.Entry)
+		case r.Op == waitOpDel && have:
+			last := len(entries) - 1
+			entries[i] = entries[last]
+			pos[entries[i].key()] = i
+			entries = entries[:last]
+			delete(pos, key)
+		}
+	}
+
+	return entries
+}
+
+func (s *waitStoreType) error(msg string, err error) {
+	log.Println(msg, err)
+	s.stat.LastError = msg + ": " + err.Error()
+}
+
+func (s *waitStoreType) stats() *waitStoreStat {
+	if fileWaitQueue == "" {
+		return nil
+	}
+
+	entries := waitQueue.len()
+
+	s.Lock()
+	defer s.Unlock()
+
+	st := s.stat
+	st.Entries = entries
+	st.LastSnapshot = s.lastSnapshot
+	st.Logged = s.logged
+
+	return &st
+}
+
+// Восстановление очереди после запуска. Истёкшие во время простоя трапы отправляются на следующей проверке
+func (t *queueToWait) restore() {
+	if fileWaitQueue == "" {
+		return
+	}
+
+	waitStore.Lock()
+	entries := waitStore.load()
+	waitStore.Unlock()
+
+	now := time.Now()
+	restored, expired := 0, 0
+
+	t.Lock()
+	for _, e := range entries {
+		key := e.key()
+		if _, have := t.m[key]; have { // Трапы, принятые до восстановления, новее
+			continue
+		}
+		t.insert(key, e.trap())
+		restored++
+		if e.Expire.Before(now) {
+			expired++
+		}
+	}
+	waitStore.snapshot(t.list())
+	t.Unlock()
+
+	waitStore.Lock()
+	waitStore.stat.Restored = restored
+	waitStore.stat.Expired = expired
+	waitStore.stat.RestoredAt = now
+	waitStore.Unlock()
+
+	log.Printf("WaitQueue: restored %d traps from %s, %d expired\n", restored, fileWaitQueue, expired)
+}
+
+// Снимок очереди по времени или размеру журнала и при остановке
+func (t *queueToWait) save() {
+	t.RLock()
+	defer t.RUnlock()
+
+	waitStore.snapshot(t.list())
+}
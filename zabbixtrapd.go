@@ -18,18 +18,29 @@ const (
 	fileNameOids    = "/usr/local/etc/zabbixtrapd/traps.txt"
 	fileNameVars    = "/usr/local/etc/zabbixtrapd/vars.txt"
 	fileNameCluster = "/usr/local/etc/zabbixtrapd/cluster.txt"
+	fileNameEngines = "/var/lib/zabbixtrapd/engines.json"
+	fileNameAccess  = "/usr/local/etc/zabbixtrapd/access.txt"
+	dirNameMibs     = "/usr/local/etc/zabbixtrapd/mibs"
+	fileNameRules   = "/usr/local/etc/zabbixtrapd/rules.json"
+	dirNameScripts  = "/usr/local/etc/zabbixtrapd/scripts"
+	fileNameWait    = "/var/lib/zabbixtrapd/waitqueue.json"
+	dirNameSpool    = "/var/lib/zabbixtrapd/spool"
 )
 
 var (
-	debug           bool
-	fileCred        string
-	fileOids        string
-	fileVars        string
-	fileCluster     string
-	fileInstance    string
-	snmpv3_user     string
-	snmpv3_password string
-	snmpv3_authtype string
+	debug         bool
+	fileCred      string
+	fileOids      string
+	fileVars      string
+	fileCluster   string
+	fileInstance  string
+	fileEngines   string
+	fileAccess    string
+	dirMibs       string
+	fileRules     string
+	dirScripts    string
+	fileWaitQueue string
+	dirSpool      string
 )
 
 func main() {
@@ -40,6 +51,13 @@ func main() {
 	fc := parser.String("u", "creditionals", &argparse.Options{Required: false, Default: credFile, Help: "creditionals file"})
 	fv := parser.String("v", "vars", &argparse.Options{Required: false, Default: fileNameVars, Help: "Vars file"})
 	fi := parser.String("i", "instance", &argparse.Options{Required: false, Default: instanceFile, Help: "Instance file"})
+	fe := parser.String("e", "engines", &argparse.Options{Required: false, Default: fileNameEngines, Help: "Learned SNMPv3 engine IDs file"})
+	fa := parser.String("a", "access", &argparse.Options{Required: false, Default: fileNameAccess, Help: "Access rules file"})
+	fm := parser.String("m", "mibs", &argparse.Options{Required: false, Default: dirNameMibs, Help: "MIB modules directory"})
+	fr := parser.String("r", "rules", &argparse.Options{Required: false, Default: fileNameRules, Help: "Variable transformation rules file"})
+	fs := parser.String("s", "scripts", &argparse.Options{Required: false, Default: dirNameScripts, Help: "Trap scripts directory"})
+	fw := parser.String("w", "waitqueue", &argparse.Options{Required: false, Default: fileNameWait, Help: "Lost traps wait queue state file, empty - don't save"})
+	fsp := parser.String("p", "spool", &argparse.Options{Required: false, Default: dirNameSpool, Help: "Undelivered batches spool directory, empty - don't save"})
 	dbg := parser.Flag("d", "debug", &argparse.Options{Required: false, Default: false, Help: "debug"})
 
 	err := parser.Parse(os.Args)
@@ -54,6 +72,13 @@ func main() {
 	fileCluster = *fcls
 	fileVars = *fv
 	fileInstance = *fi
+	fileEngines = *fe
+	fileAccess = *fa
+	dirMibs = *fm
+	fileRules = *fr
+	dirScripts = *fs
+	fileWaitQueue = *fw
+	dirSpool = *fsp
 	debug = *dbg
 	// test := *tst
 
@@ -70,6 +95,8 @@ func main() {
 		log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	}
 
+	engines.startBoots() // До приёма SNMPv3 InformRequest
+
 	go loadConfigs()   // В 1 поток
 	go dbs.loadHosts() // В 1 поток
 
@@ -79,52 +106,27 @@ func main() {
 		go trapConverter()
 		go trapProxy()
 	}
-	go trapLost() // В 1 поток
-
-	tl := snmp.NewTrapListener()
-	defer tl.Close()
+	go trapLost()       // В 1 поток
+	go storm.reporter() // В 1 поток
+	go dedup.flusher()  // В 1 поток
 
 	credCond.L.Lock()
-	credCond.Wait()
-
-	tl.OnNewTrap = myTrapHandler
-	tl.Params = snmp.Default
-	tl.Params.Version = snmp.Version3
-	tl.Params.SecurityModel = snmp.UserSecurityModel
-
-	switch snmpv3_authtype { // Обязательно поставить AuthNoPriv и указать логин/пароль !!!!
-	case "NoAuthNoPriv":
-		tl.Params.MsgFlags = snmp.NoAuthNoPriv
-	case "AuthNoPriv":
-		tl.Params.MsgFlags = snmp.AuthNoPriv
-	default:
-		tl.Params.MsgFlags = snmp.AuthNoPriv
-	}
-
-	tl.Params.SecurityParameters = &snmp.UsmSecurityParameters{
-		UserName:                 snmpv3_user,
-		AuthoritativeEngineID:    "1234",
-		AuthenticationProtocol:   snmp.SHA,
-		AuthenticationPassphrase: snmpv3_password,
-		PrivacyProtocol:          snmp.AES,
-		PrivacyPassphrase:        "password",
-		Logger:                   snmp.NewLogger(log.Default()), // (log.New(os.Stdout, "", 0)),
-	}
-	// tl.Params.Logger = snmp.NewLogger(log.New(os.Stdout, "", 0))
-
+	credCond.Wait() // Ждём загрузки пользователей SNMPv3 и адресов приёма
 	credCond.L.Unlock()
 
-	// fmt.Printf("tl: %+v\n\n%+v\n\n%+v\n\n\n", tl, tl.Params, tl.Params.SecurityParameters)
+	waitQueue.restore() // После загрузки traps.txt: ключ и формат значения трапов
 
-	log.Fatal(tl.Listen("0.0.0.0:162"))
+	log.Fatal(listeners.listen())
 }
 
-func myTrapHandler(packet *snmp.SnmpPacket, addr *net.UDPAddr) {
+func myTrapHandler(packet *snmp.SnmpPacket, addr *net.UDPAddr, transport string, raw []byte) {
 	var trap trapRaw
 
 	trap.time = time.Now()
 	trap.addr = *addr
+	trap.transport = transport
 	trap.packet = *packet
+	trap.raw = raw
 
 	chTrapRaw <- trap
 